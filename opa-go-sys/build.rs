@@ -12,11 +12,109 @@ fn main() {
         .header(header.display().to_string())
         .parse_callbacks(Box::new(bindgen::CargoCallbacks))
         .whitelist_function("Free")
+        .whitelist_function("FreeCString")
         .whitelist_function("RegoNew")
+        .whitelist_function("RegoNewModules")
+        .whitelist_function("RegoNewCompressed")
+        .whitelist_function("RegoNewRelaxed")
+        .whitelist_function("RegoNewInterned")
+        .whitelist_function("RegoNewBounded")
+        .whitelist_function("RegoNewMultiQuery")
+        .whitelist_function("RegoCompileModules")
+        .whitelist_function("RegoNewFromCompiler")
+        .whitelist_function("RegoDropCompiler")
+        .whitelist_function("RegoNewWithData")
+        .whitelist_function("RegoNewWithDataPaths")
+        .whitelist_function("RegoNewWithRuntime")
+        .whitelist_function("RegoNewWithIndexing")
+        .whitelist_function("RegoNewFromBundle")
+        .whitelist_function("RegoNewFromPath")
+        .whitelist_function("RegoNewRestricted")
+        .whitelist_function("RegoReplaceModule")
         .whitelist_function("RegoDrop")
+        .whitelist_function("RegoRetain")
+        .whitelist_function("RegoDropAll")
+        .whitelist_function("RegoListIds")
+        .whitelist_function("RegoCount")
+        .whitelist_function("RegoNewEvaluator")
+        .whitelist_function("RegoDropEvaluator")
+        .whitelist_function("RegoEvaluatorNew")
+        .whitelist_function("RegoEvaluatorEval")
+        .whitelist_function("RegoEvaluatorDrop")
         .whitelist_function("RegoEval")
+        .whitelist_function("RegoEvalNoInput")
+        .whitelist_function("RegoWarmup")
+        .whitelist_function("RegoEvalBytes")
+        .whitelist_function("RegoEvalBytesInput")
+        .whitelist_function("RegoParseInput")
+        .whitelist_function("RegoEvalWithInputToken")
+        .whitelist_function("RegoDropInput")
+        .whitelist_function("RegoEvalAtPath")
+        .whitelist_function("RegoEvalPath")
+        .whitelist_function("RegoDataQuery")
+        .whitelist_function("RegoEvalDefault")
+        .whitelist_function("RegoEvalWithOverlay")
+        .whitelist_function("RegoEvalRuleValue")
+        .whitelist_function("RegoEvalExpressions")
+        .whitelist_function("RegoEvalDecision")
+        .whitelist_function("RegoEvalWithProvenance")
+        .whitelist_function("RegoEvalFirstResult")
+        .whitelist_function("RegoEvalPage")
+        .whitelist_function("RegoEvalObject")
+        .whitelist_function("RegoEvalBindings")
+        .whitelist_function("RegoEvalParsed")
+        .whitelist_function("RegoEvalBatch")
+        .whitelist_function("RegoEvalMany")
+        .whitelist_function("RegoEvalCombine")
+        .whitelist_function("RegoEvalWithTimeout")
+        .whitelist_function("RegoEvalWithLimits")
+        .whitelist_function("RegoNewCancel")
+        .whitelist_function("RegoCancel")
+        .whitelist_function("RegoReleaseCancel")
+        .whitelist_function("RegoEvalCancellable")
+        .whitelist_function("RegoEvalWithMetrics")
+        .whitelist_function("RegoEvalTraced")
+        .whitelist_function("RegoEvalInstrumented")
+        .whitelist_function("RegoEvalExplain")
+        .whitelist_function("RegoEvalWithPrints")
+        .whitelist_function("RegoEvalWithCoverage")
+        .whitelist_function("RegoSetData")
+        .whitelist_function("RegoRemoveData")
+        .whitelist_function("RegoPatchData")
+        .whitelist_function("RegoBeginTxn")
+        .whitelist_function("RegoEvalInTxn")
+        .whitelist_function("RegoCommitTxn")
+        .whitelist_function("RegoAbortTxn")
         .whitelist_function("RegoEvalBool")
+        .whitelist_function("RegoEvalBoolStrict")
+        .whitelist_function("RegoEvalBoolDefined")
+        .whitelist_function("RegoEvalString")
+        .whitelist_function("RegoEvalFloat")
+        .whitelist_function("RegoEvalInt")
+        .whitelist_function("RegoEvalCount")
+        .whitelist_function("RegoCheck")
+        .whitelist_function("RegoCheckRelaxed")
+        .whitelist_function("RegoCheckPath")
+        .whitelist_function("RegoParseModule")
+        .whitelist_function("RegoRules")
+        .whitelist_function("RegoCompileQuery")
+        .whitelist_function("RegoFormat")
+        .whitelist_function("RegoQueryData")
+        .whitelist_function("RegoPartial")
+        .whitelist_function("RegoSetBuiltinCallback")
+        .whitelist_function("RegoRegisterBuiltin")
+        .whitelist_function("RegoSetDecisionLogCallback")
+        .whitelist_function("RegoSetDecisionLogging")
         .whitelist_function("WasmBuild")
+        .whitelist_function("WasmBuildFromModules")
+        .whitelist_function("WasmBuildWithCapabilities")
+        .whitelist_function("WasmBuildOptimized")
+        .whitelist_function("WasmBuildBundle")
+        .whitelist_function("WasmBuildWithReport")
+        .whitelist_function("RegoCapabilities")
+        .whitelist_function("OpaVersion")
+        .whitelist_function("OpaVersionInfo")
+        .whitelist_function("RegoSelfTest")
         .clang_arg("-I/usr/arm-linux-gnueabihf/include")
         .generate()
         .expect("Unable to generate bindings");
@@ -1,168 +1,4191 @@
 package main
 
-// #include <stdlib.h>
+/*
+#include <stdlib.h>
+
+typedef char* (*builtin_callback)(unsigned long long token, char* args, char** err);
+
+static inline char* call_builtin(builtin_callback cb, unsigned long long token, char* args, char** err) {
+	return cb(token, args, err);
+}
+
+typedef void (*decision_log_callback)(unsigned long long token, char* decision);
+
+static inline void call_decision_log(decision_log_callback cb, unsigned long long token, char* decision) {
+	cb(token, decision);
+}
+*/
 import "C"
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
 	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 	"unsafe"
 
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/bundle"
+	"github.com/open-policy-agent/opa/cover"
+	"github.com/open-policy-agent/opa/format"
 	"github.com/open-policy-agent/opa/loader"
+	"github.com/open-policy-agent/opa/metrics"
 	"github.com/open-policy-agent/opa/rego"
+	servertypes "github.com/open-policy-agent/opa/server/types"
+	"github.com/open-policy-agent/opa/storage"
+	"github.com/open-policy-agent/opa/storage/inmem"
+	"github.com/open-policy-agent/opa/topdown"
+	"github.com/open-policy-agent/opa/topdown/lineage"
+	"github.com/open-policy-agent/opa/types"
+	"github.com/open-policy-agent/opa/util"
+	"github.com/open-policy-agent/opa/version"
 )
 
+// policy is a prepared query together with the store holding its data and the
+// compiler holding its modules. Policies are not modified once registered.
+type policy struct {
+	query        rego.PreparedEvalQuery
+	store        storage.Store
+	compiler     *ast.Compiler
+	logDecisions bool
+
+	// internKey is set for policies registered by RegoNewInterned.
+	internKey string
+
+	// revision is the revision in the manifest of the bundle the policy was
+	// loaded from, if any.
+	revision string
+
+	options prepareOptions
+
+	// prepareMutex serializes preparing queries against compiler, which may
+	// be shared with other policies, such as those of RegoNewMultiQuery or
+	// RegoNewFromCompiler.
+	prepareMutex *sync.Mutex
+}
+
+// evaluator holds a set of policies, keyed by id. Each evaluator has its own
+// ids and lock, so queries in one evaluator are isolated from those in
+// another. The Rego* functions that take no evaluator use defaultEvaluator.
+//
+// Lookups hold mutex for reading; anything that changes registry or ids holds
+// it for writing. PreparedEvalQuery is safe for concurrent use, so nothing
+// needs the lock while evaluating.
+//
+// Evaluations look up their query under the lock and release it before
+// evaluating, so RegoDrop only unregisters the id: an evaluation already in
+// flight keeps its own reference and completes normally, while any call made
+// after RegoDrop returns fails with "could not find rego query".
+type evaluator struct {
+	mutex    sync.RWMutex
+	registry map[uint64]*policy
+	ids      uint64
+
+	// interned maps the key of each interned policy to its id. refs counts
+	// the references held to each id; an id missing from refs has one.
+	interned map[string]uint64
+	refs     map[uint64]int
+}
+
+func newEvaluator() *evaluator {
+	return &evaluator{
+		registry: make(map[uint64]*policy),
+		interned: make(map[string]uint64),
+		refs:     make(map[uint64]int),
+	}
+}
+
+var defaultEvaluator = newEvaluator()
+
+type cancelContext struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// cancels holds the contexts handed out by RegoNewCancel, keyed by token.
 var (
-	registry        = make(map[uint64]*rego.PreparedEvalQuery)
-	mutex           = &sync.Mutex{}
-	ids      uint64 = 0
+	cancels            = make(map[uint64]cancelContext)
+	cancelMutex        = &sync.Mutex{}
+	cancelIds   uint64 = 0
 )
 
 //export RegoNew
 func RegoNew(query string, modulename string, modulecontent string) (uint64, *C.char) {
 	ctx := context.Background()
 
-	prepared, err := rego.New(
+	id, err := prepare(ctx, inmem.New(),
 		rego.Query(query),
-		rego.Module(modulename, modulecontent),
-	).PrepareForEval(ctx)
+		rego.Module(clone(modulename), modulecontent),
+	)
+	if err != nil {
+		return 0, cError(err)
+	}
+
+	return id, nil
+}
+
+// RegoNewCompressed is like RegoNew, but reads the module from the
+// contentLen bytes of gzip-compressed source at gzippedContent.
+//
+//export RegoNewCompressed
+func RegoNewCompressed(query string, modulename string, gzippedContent unsafe.Pointer, contentLen int) (uint64, *C.char) {
+	ctx := context.Background()
+
+	if contentLen < 0 {
+		return 0, cError(invalidArgument("content length must not be negative, got %d", contentLen))
+	}
+
+	gr, err := gzip.NewReader(bytes.NewReader(C.GoBytes(gzippedContent, C.int(contentLen))))
+	if err != nil {
+		return 0, cError(withCode(codeInvalidInput, err))
+	}
 
+	modulecontent, err := ioutil.ReadAll(gr)
 	if err != nil {
-		return 0, C.CString(err.Error())
+		return 0, cError(withCode(codeInvalidInput, err))
 	}
 
-	mutex.Lock()
-	ids += 1
-	var id = ids
-	registry[ids] = &prepared
-	mutex.Unlock()
+	id, err := prepare(ctx, inmem.New(),
+		rego.Query(query),
+		rego.Module(clone(modulename), string(modulecontent)),
+	)
+	if err != nil {
+		return 0, cError(err)
+	}
 
 	return id, nil
 }
 
-//export RegoDrop
-func RegoDrop(id uint64) {
-	delete(registry, id)
+// RegoNewBounded is like RegoNew, but rejects a module larger than maxBytes
+// bytes before parsing it, or containing more than maxTerms terms after
+// parsing it, with a "too_large" error. A limit of 0 disables that check.
+//
+//export RegoNewBounded
+func RegoNewBounded(query string, modulename string, modulecontent string, maxBytes int, maxTerms int) (uint64, *C.char) {
+	ctx := context.Background()
+
+	if maxBytes > 0 && len(modulecontent) > maxBytes {
+		return 0, cError(withCode(codeTooLarge, fmt.Errorf("policy too large: %d bytes exceeds the limit of %d", len(modulecontent), maxBytes)))
+	}
+
+	if maxTerms > 0 {
+		module, err := ast.ParseModule(modulename, modulecontent)
+		if err != nil {
+			return 0, cError(withCode(codeCompile, err))
+		}
+
+		terms := 0
+		ast.WalkTerms(module, func(*ast.Term) bool {
+			terms++
+			return false
+		})
+
+		if terms > maxTerms {
+			return 0, cError(withCode(codeTooLarge, fmt.Errorf("policy too large: %d terms exceeds the limit of %d", terms, maxTerms)))
+		}
+	}
+
+	id, err := prepare(ctx, inmem.New(),
+		rego.Query(query),
+		rego.Module(clone(modulename), modulecontent),
+	)
+	if err != nil {
+		return 0, cError(err)
+	}
+
+	return id, nil
 }
 
-//export RegoEvalBool
-func RegoEvalBool(id uint64, inputstr string) (bool, *C.char) {
+// RegoNewModules is like RegoNew, but compiles each of names[i] and
+// contents[i] as a separate module. Compile errors are reported against the
+// name of the module they occur in.
+//
+//export RegoNewModules
+func RegoNewModules(query string, names []string, contents []string) (uint64, *C.char) {
 	ctx := context.Background()
 
-	mutex.Lock()
-	query, found := registry[id]
-	mutex.Unlock()
+	if len(names) != len(contents) {
+		return 0, cError(invalidArgument("got %d module names but %d module contents", len(names), len(contents)))
+	}
 
-	if !found {
-		return false, C.CString("could not find rego query")
+	regoArgs := []func(*rego.Rego){
+		rego.Query(query),
 	}
 
-	var input interface{}
-	bytes := []byte(inputstr)
-	err := json.Unmarshal(bytes, &input)
+	for i := range names {
+		regoArgs = append(regoArgs, rego.Module(clone(names[i]), contents[i]))
+	}
+
+	id, err := prepare(ctx, inmem.New(), regoArgs...)
 	if err != nil {
-		return false, C.CString(err.Error())
+		return 0, cError(err)
+	}
+
+	return id, nil
+}
+
+// RegoNewMultiQuery is like RegoNewModules, but prepares each of queries
+// against the same modules, compiling them only once. It stores the id of
+// queries[i] in ids[i], so ids must be at least as long as queries. The
+// queries also share their data, so RegoSetData on any of them is seen by
+// all. If any query fails to prepare, none are registered.
+//
+//export RegoNewMultiQuery
+func RegoNewMultiQuery(queries []string, names []string, contents []string, ids []uint64) *C.char {
+	ctx := context.Background()
+
+	if len(queries) == 0 {
+		return cError(invalidArgument("no queries given"))
+	}
+
+	if len(ids) < len(queries) {
+		return cError(invalidArgument("got %d queries but room for only %d ids", len(queries), len(ids)))
+	}
+
+	if len(names) != len(contents) {
+		return cError(invalidArgument("got %d module names but %d module contents", len(names), len(contents)))
+	}
+
+	regoArgs := []func(*rego.Rego){
+		rego.Query(queries[0]),
+	}
+
+	for i := range names {
+		regoArgs = append(regoArgs, rego.Module(clone(names[i]), contents[i]))
 	}
 
-	results, err := query.Eval(ctx, rego.EvalInput(input))
+	store := inmem.New()
+	compiler := newCompiler()
+
+	first, err := newPolicy(ctx, store, compiler, regoArgs...)
 	if err != nil {
-		return false, C.CString(err.Error())
-	} else if len(results) == 0 {
-		return false, nil
-	} else if len(results[0].Expressions) > 0 {
-		if b, ok := results[0].Expressions[0].Value.(bool); ok {
-			return b, nil
-		} else {
-			return false, nil
+		return cError(err)
+	}
+
+	policies := []*policy{first}
+
+	// The compiler now holds the compiled modules, so the remaining queries
+	// are prepared against it without passing the modules again.
+	for _, query := range queries[1:] {
+		p, err := newPolicy(ctx, store, compiler, rego.Query(query))
+		if err != nil {
+			return cError(err)
 		}
-	} else {
-		return false, nil
+		p.prepareMutex = first.prepareMutex
+		policies = append(policies, p)
+	}
+
+	for i, p := range policies {
+		id, err := defaultEvaluator.register(p)
+		if err != nil {
+			for _, registered := range ids[:i] {
+				defaultEvaluator.drop(registered)
+			}
+			return cError(err)
+		}
+		ids[i] = id
 	}
+
+	return nil
 }
 
-//export RegoEval
-func RegoEval(id uint64, inputstr string) (*C.char, *C.char) {
+// compiledModules is a set of modules compiled by RegoCompileModules.
+type compiledModules struct {
+	// mutex serializes preparing queries against the compiler.
+	mutex    sync.Mutex
+	compiler *ast.Compiler
+	store    storage.Store
+}
+
+// compilers holds the modules compiled by RegoCompileModules, keyed by token.
+var (
+	compilers            = make(map[uint64]*compiledModules)
+	compilerMutex        = &sync.RWMutex{}
+	compilerIds   uint64 = 0
+)
+
+var errCompilerNotFound = withCode(codeNotFound, errors.New("could not find compiled modules"))
+
+// RegoCompileModules parses and compiles the modules names[i] with contents
+// contents[i] once, and returns a token that RegoNewFromCompiler prepares
+// queries against. It returns a "compile_error" if any module fails to parse
+// or compile.
+//
+//export RegoCompileModules
+func RegoCompileModules(names []string, contents []string) (uint64, *C.char) {
+	if len(names) != len(contents) {
+		return 0, cError(invalidArgument("got %d module names but %d module contents", len(names), len(contents)))
+	}
+
+	modules := make(map[string]*ast.Module, len(names))
+	for i := range names {
+		name := clone(names[i])
+		module, err := ast.ParseModule(name, contents[i])
+		if err != nil {
+			return 0, cError(withCode(codeCompile, err))
+		}
+		modules[name] = module
+	}
+
+	compiler := newCompiler()
+	compiler.Compile(modules)
+	if compiler.Failed() {
+		return 0, cError(withCode(codeCompile, compiler.Errors))
+	}
+
+	compilerMutex.Lock()
+	compilerIds += 1
+	var token = compilerIds
+	compilers[token] = &compiledModules{compiler: compiler, store: inmem.New()}
+	compilerMutex.Unlock()
+
+	return token, nil
+}
+
+// RegoNewFromCompiler prepares query against the modules compiled by
+// RegoCompileModules without compiling them again, and returns its id like
+// RegoNew. Queries prepared from the same token share their data, so
+// RegoSetData on any of them is seen by all. The queries stay registered
+// after RegoDropCompiler.
+//
+//export RegoNewFromCompiler
+func RegoNewFromCompiler(compilerToken uint64, query string) (uint64, *C.char) {
 	ctx := context.Background()
 
-	mutex.Lock()
-	query, found := registry[id]
-	mutex.Unlock()
+	compilerMutex.RLock()
+	c, found := compilers[compilerToken]
+	compilerMutex.RUnlock()
 
 	if !found {
-		return nil, C.CString("could not find rego query")
+		return 0, cError(errCompilerNotFound)
 	}
 
-	var input interface{}
-	bytes := []byte(inputstr)
-	err := json.Unmarshal(bytes, &input)
+	c.mutex.Lock()
+	p, err := newPolicy(ctx, c.store, c.compiler, rego.Query(query))
+	c.mutex.Unlock()
 	if err != nil {
-		return nil, C.CString(err.Error())
+		return 0, cError(err)
 	}
+	p.prepareMutex = &c.mutex
 
-	results, err := query.Eval(ctx, rego.EvalInput(input))
+	id, err := defaultEvaluator.register(p)
 	if err != nil {
-		return nil, C.CString(err.Error())
+		return 0, cError(err)
 	}
 
-	jbytes, err := json.Marshal(results)
+	return id, nil
+}
+
+// RegoDropCompiler releases the modules compiled by RegoCompileModules.
+//
+//export RegoDropCompiler
+func RegoDropCompiler(compilerToken uint64) {
+	compilerMutex.Lock()
+	delete(compilers, compilerToken)
+	compilerMutex.Unlock()
+}
+
+// RegoNewWithData is like RegoNew, but seeds the base data document from
+// dataJSON, which must be a JSON object. The data is shared by every
+// evaluation of the returned query.
+//
+//export RegoNewWithData
+func RegoNewWithData(query string, modulename string, modulecontent string, dataJSON string) (uint64, *C.char) {
+	ctx := context.Background()
+
+	var data map[string]interface{}
+	err := util.UnmarshalJSON([]byte(dataJSON), &data)
 	if err != nil {
-		return nil, C.CString(err.Error())
+		return 0, cError(withCode(codeInvalidInput, err))
 	}
 
-	return C.CString(string(jbytes)), nil
+	id, err := prepare(ctx, inmem.NewFromObject(data),
+		rego.Query(query),
+		rego.Module(clone(modulename), modulecontent),
+	)
+	if err != nil {
+		return 0, cError(err)
+	}
+
+	return id, nil
 }
 
-// Wasm
+// RegoNewWithDataPaths is like RegoNewWithData, but builds the base data
+// document from several JSON values, placing each of valuesJSON at the
+// slash-separated path (e.g. "/config") at the same index of paths. Objects
+// placed at overlapping paths are merged; any other overlap is an
+// "invalid_argument" error naming the conflicting path.
+//
+//export RegoNewWithDataPaths
+func RegoNewWithDataPaths(query string, modulename string, modulecontent string, paths []string, valuesJSON []string) (uint64, *C.char) {
+	ctx := context.Background()
 
-type loaderFilter struct {
-	Ignore []string
-}
+	if len(paths) != len(valuesJSON) {
+		return 0, cError(invalidArgument("got %d paths but %d values", len(paths), len(valuesJSON)))
+	}
 
-func (f loaderFilter) Apply(abspath string, info os.FileInfo, depth int) bool {
-	for _, s := range f.Ignore {
-		if loader.GlobExcludeName(s, 1)(abspath, info, depth) {
-			return true
+	data := map[string]interface{}{}
+	for i, path := range paths {
+		// The segments of the path become keys of the base data document,
+		// so they must not point into the caller's memory.
+		storagePath, ok := storage.ParsePath(clone(path))
+		if !ok {
+			return 0, cError(invalidArgument("invalid data path %q", path))
+		}
+
+		var value interface{}
+		err := util.UnmarshalJSON([]byte(valuesJSON[i]), &value)
+		if err != nil {
+			return 0, cError(withCode(codeInvalidInput, err))
+		}
+
+		for j := len(storagePath) - 1; j >= 0; j-- {
+			value = map[string]interface{}{storagePath[j]: value}
+		}
+
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return 0, cError(withCode(codeInvalidInput, fmt.Errorf("data at %q must be an object", path)))
+		}
+
+		if err := mergeData(data, obj, nil); err != nil {
+			return 0, cError(err)
 		}
 	}
-	return false
+
+	id, err := prepare(ctx, inmem.NewFromObject(data),
+		rego.Query(query),
+		rego.Module(clone(modulename), modulecontent),
+	)
+	if err != nil {
+		return 0, cError(err)
+	}
+
+	return id, nil
 }
 
-//export WasmBuild
-func WasmBuild(query string, data, bundles, ignore []string) (unsafe.Pointer, int, *C.char) {
+// RegoNewWithIndexing is like RegoNew, but if disableIndexing is set, every
+// evaluation of the query considers all rules rather than using OPA's rule
+// indices to skip those that cannot match the input. Results do not change,
+// so this is only useful to rule out an indexing bug when debugging a policy.
+//
+//export RegoNewWithIndexing
+func RegoNewWithIndexing(query string, modulename string, modulecontent string, disableIndexing bool) (uint64, *C.char) {
+	ctx := context.Background()
+
+	options := prepareOptions{disableIndexing: disableIndexing}
+
+	id, err := prepareWithOptions(ctx, inmem.New(), options,
+		rego.Query(query),
+		rego.Module(clone(modulename), modulecontent),
+	)
+	if err != nil {
+		return 0, cError(err)
+	}
+
+	return id, nil
+}
+
+// RegoNewWithRuntime is like RegoNew, but makes runtimeJSON available to the
+// policy as the value of opa.runtime().
+//
+//export RegoNewWithRuntime
+func RegoNewWithRuntime(query string, modulename string, modulecontent string, runtimeJSON string) (uint64, *C.char) {
+	ctx := context.Background()
+
+	var info interface{}
+	err := util.UnmarshalJSON([]byte(runtimeJSON), &info)
+	if err != nil {
+		return 0, cError(withCode(codeInvalidInput, err))
+	}
+
+	value, err := ast.InterfaceToValue(info)
+	if err != nil {
+		return 0, cError(withCode(codeInvalidInput, err))
+	}
+
+	options := prepareOptions{runtime: ast.NewTerm(value)}
+
+	id, err := prepareWithOptions(ctx, inmem.New(), options,
+		rego.Query(query),
+		rego.Module(clone(modulename), modulecontent),
+	)
+	if err != nil {
+		return 0, cError(err)
+	}
+
+	return id, nil
+}
+
+// RegoNewFromBundle is like RegoNew, but loads modules and data from the
+// bundle directory or .tar.gz archive at bundlePath. The revision in the
+// bundle's manifest is reported by RegoEvalWithProvenance.
+//
+//export RegoNewFromBundle
+func RegoNewFromBundle(query string, bundlePath string) (uint64, *C.char) {
+	ctx := context.Background()
+
+	b, err := loader.AsBundle(bundlePath)
+	if err != nil {
+		return 0, cError(withCode(codeCompile, err))
+	}
+
+	regoArgs := []func(*rego.Rego){rego.Query(query)}
+	for _, m := range b.Modules {
+		regoArgs = append(regoArgs, rego.ParsedModule(m.Parsed))
+	}
+
+	p, err := newPolicy(ctx, inmem.NewFromObject(b.Data), newCompiler(), regoArgs...)
+	if err != nil {
+		return 0, cError(err)
+	}
+	p.revision = b.Manifest.Revision
+
+	id, err := defaultEvaluator.register(p)
+	if err != nil {
+		return 0, cError(err)
+	}
+
+	return id, nil
+}
+
+// RegoNewFromPath is like RegoNew, but loads modules and data files from
+// paths, skipping any file or directory whose name matches one of the ignore
+// patterns, in the same way as WasmBuild.
+//
+//export RegoNewFromPath
+func RegoNewFromPath(query string, paths []string, ignore []string) (uint64, *C.char) {
 	ctx := context.Background()
 
 	f := loaderFilter{
 		Ignore: ignore,
 	}
 
-	regoArgs := []func(*rego.Rego){
+	id, err := prepare(ctx, inmem.New(),
 		rego.Query(query),
+		rego.Load(cloneAll(paths), f.Apply),
+	)
+	if err != nil {
+		return 0, cError(err)
 	}
 
-	if len(data) > 0 {
-		regoArgs = append(regoArgs, rego.Load(data, f.Apply))
+	return id, nil
+}
+
+// RegoNewRestricted is like RegoNew, but fails to compile if the module or
+// query calls any of the builtins named in blocklistJSON, a JSON array of
+// builtin names such as ["http.send"].
+//
+//export RegoNewRestricted
+func RegoNewRestricted(query string, modulename string, modulecontent string, blocklistJSON string) (uint64, *C.char) {
+	ctx := context.Background()
+
+	var blocklist []string
+	if err := json.Unmarshal([]byte(blocklistJSON), &blocklist); err != nil {
+		return 0, cError(invalidArgument("invalid builtin blocklist: %v", err))
 	}
 
-	if len(bundles) > 0 {
-		for _, bundleDir := range bundles {
-			regoArgs = append(regoArgs, rego.LoadBundle(bundleDir))
-		}
+	unsafeBuiltins := make(map[string]struct{}, len(blocklist))
+	for _, name := range blocklist {
+		unsafeBuiltins[name] = struct{}{}
 	}
 
-	r := rego.New(regoArgs...)
-	cr, err := r.Compile(ctx, rego.CompilePartial(false))
+	options := prepareOptions{unsafeBuiltins: unsafeBuiltins}
+
+	id, err := prepareWithOptions(ctx, inmem.New(), options,
+		rego.Query(query),
+		rego.Module(clone(modulename), modulecontent),
+	)
 	if err != nil {
-		return nil, 0, C.CString(err.Error())
+		return 0, cError(err)
 	}
 
-	return C.CBytes(cr.Bytes), len(cr.Bytes), nil
+	return id, nil
 }
 
-//export Free
-func Free(ptr unsafe.Pointer) {
-	C.free(ptr)
+func prepare(ctx context.Context, store storage.Store, regoArgs ...func(*rego.Rego)) (uint64, error) {
+	return prepareWithOptions(ctx, store, prepareOptions{}, regoArgs...)
+}
+
+func prepareWithOptions(ctx context.Context, store storage.Store, options prepareOptions, regoArgs ...func(*rego.Rego)) (uint64, error) {
+	p, err := newPolicyWithOptions(ctx, store, options.compiler(), options, regoArgs...)
+	if err != nil {
+		return 0, err
+	}
+
+	return defaultEvaluator.register(p)
+}
+
+// newCompiler returns a compiler that declares the builtins added with
+// RegoRegisterBuiltin. rego only declares the functions passed to it with
+// rego.FunctionDyn to compilers it creates itself, so any compiler passed to
+// rego.Compiler must come from here.
+func newCompiler() *ast.Compiler {
+	return ast.NewCompiler().WithBuiltins(builtinDecls())
+}
+
+// prepareOptions are the options a policy was prepared with beyond its
+// query, modules and data. They are reapplied whenever a query is prepared
+// again from the policy, so that, for example, replacing the module of a
+// restricted policy cannot lift its restrictions.
+type prepareOptions struct {
+	// unsafeBuiltins are the builtins forbidden by RegoNewRestricted.
+	unsafeBuiltins map[string]struct{}
+
+	// runtime is the value of opa.runtime() given to RegoNewWithRuntime.
+	runtime *ast.Term
+
+	// relaxed are the unknown builtins stubbed out by RegoNewRelaxed, with
+	// the arity of each.
+	relaxed map[string]int
+
+	// disableIndexing is set by RegoNewWithIndexing to evaluate without rule
+	// indexing.
+	disableIndexing bool
+}
+
+// compiler returns a compiler for the modules of a policy prepared with the
+// options. Like newCompiler, it declares the registered builtins.
+func (o prepareOptions) compiler() *ast.Compiler {
+	decls := builtinDecls()
+	for name, decl := range unknownDecls(o.relaxed) {
+		decls[name] = &ast.Builtin{Name: decl.Name, Decl: decl.Decl}
+	}
+
+	compiler := ast.NewCompiler().WithBuiltins(decls)
+	if o.unsafeBuiltins != nil {
+		compiler = compiler.WithUnsafeBuiltins(o.unsafeBuiltins)
+	}
+
+	return compiler
+}
+
+func (o prepareOptions) regoArgs() []func(*rego.Rego) {
+	var regoArgs []func(*rego.Rego)
+	if o.unsafeBuiltins != nil {
+		regoArgs = append(regoArgs, rego.UnsafeBuiltins(o.unsafeBuiltins))
+	}
+	if o.runtime != nil {
+		regoArgs = append(regoArgs, rego.Runtime(o.runtime))
+	}
+	for _, decl := range unknownDecls(o.relaxed) {
+		regoArgs = append(regoArgs, rego.FunctionDyn(decl, undefinedBuiltin))
+	}
+	return regoArgs
+}
+
+func newPolicy(ctx context.Context, store storage.Store, compiler *ast.Compiler, regoArgs ...func(*rego.Rego)) (*policy, error) {
+	return newPolicyWithOptions(ctx, store, compiler, prepareOptions{}, regoArgs...)
+}
+
+// newPolicyWithOptions prepares a policy against compiler, which must have
+// been created by options.compiler() or already hold modules compiled by one.
+func newPolicyWithOptions(ctx context.Context, store storage.Store, compiler *ast.Compiler, options prepareOptions, regoArgs ...func(*rego.Rego)) (*policy, error) {
+	regoArgs = append(regoArgs, rego.Store(store), rego.Compiler(compiler))
+	regoArgs = append(regoArgs, options.regoArgs()...)
+	regoArgs = append(regoArgs, builtinArgs()...)
+
+	prepared, err := rego.New(regoArgs...).PrepareForEval(ctx)
+	if err != nil {
+		return nil, withCode(codeCompile, err)
+	}
+
+	return &policy{
+		query:        prepared,
+		store:        store,
+		compiler:     compiler,
+		logDecisions: true,
+		options:      options,
+		prepareMutex: &sync.Mutex{},
+	}, nil
+}
+
+// clone copies s into Go memory. Strings passed in from C point at memory the
+// caller owns, so any that outlive the call (such as module names, which end
+// up in the compiled AST) must be copied first.
+func clone(s string) string {
+	return string([]byte(s))
+}
+
+func cloneAll(ss []string) []string {
+	cloned := make([]string, len(ss))
+	for i := range ss {
+		cloned[i] = clone(ss[i])
+	}
+	return cloned
+}
+
+// maxQueries caps the number of queries registered in an evaluator. As fewer
+// than maxQueries ids are live, the search for a free id in registerLocked
+// ends within maxQueries + 1 steps.
+var maxQueries = math.MaxInt32
+
+// register stores p under a free id. Ids wrap around on overflow, skipping
+// ids that are still live and 0, which RegoNew returns on error.
+func (e *evaluator) register(p *policy) (uint64, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	return e.registerLocked(p)
+}
+
+func (e *evaluator) registerLocked(p *policy) (uint64, error) {
+	if len(e.registry) >= maxQueries {
+		return 0, withCode(codeResourceLimit, fmt.Errorf("no free rego query ids: %d queries are registered", len(e.registry)))
+	}
+
+	for {
+		e.ids += 1
+		if _, found := e.registry[e.ids]; e.ids != 0 && !found {
+			break
+		}
+	}
+	e.registry[e.ids] = p
+
+	return e.ids, nil
+}
+
+// acquire returns the id of the policy interned under key, adding a
+// reference to it, if there is one.
+func (e *evaluator) acquire(key string) (uint64, bool) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	id, found := e.interned[key]
+	if found {
+		e.refs[id]++
+	}
+
+	return id, found
+}
+
+// registerInterned is like register, but if a policy was interned under the
+// same key in the meantime, it adds a reference to that one instead.
+func (e *evaluator) registerInterned(p *policy) (uint64, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if id, found := e.interned[p.internKey]; found {
+		e.refs[id]++
+		return id, nil
+	}
+
+	id, err := e.registerLocked(p)
+	if err != nil {
+		return 0, err
+	}
+
+	e.interned[p.internKey] = id
+	e.refs[id] = 1
+
+	return id, nil
+}
+
+func (e *evaluator) lookup(id uint64) (*policy, error) {
+	e.mutex.RLock()
+	p, found := e.registry[id]
+	e.mutex.RUnlock()
+
+	if !found {
+		return nil, errNotFound
+	}
+
+	return p, nil
+}
+
+// update replaces the policy registered under id with the result of calling
+// f with it.
+func (e *evaluator) update(id uint64, f func(p *policy) *policy) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	p, found := e.registry[id]
+	if !found {
+		return errNotFound
+	}
+
+	updated := f(p)
+	if p.internKey != updated.internKey {
+		// The policy no longer matches its key, so later RegoNewInterned
+		// calls must not share it.
+		delete(e.interned, p.internKey)
+	}
+	e.registry[id] = updated
+
+	return nil
+}
+
+// list returns the ids of the registered policies in ascending order.
+func (e *evaluator) list() []uint64 {
+	e.mutex.RLock()
+	list := make([]uint64, 0, len(e.registry))
+	for id := range e.registry {
+		list = append(list, id)
+	}
+	e.mutex.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i] < list[j] })
+
+	return list
+}
+
+func (e *evaluator) count() int {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+
+	return len(e.registry)
+}
+
+// retain adds a reference to id.
+func (e *evaluator) retain(id uint64) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if _, found := e.registry[id]; !found {
+		return errNotFound
+	}
+
+	if e.refs[id] == 0 {
+		e.refs[id] = 1
+	}
+	e.refs[id]++
+
+	return nil
+}
+
+// drop releases one reference to id, and unregisters it once none are left.
+func (e *evaluator) drop(id uint64) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if e.refs[id] > 1 {
+		e.refs[id]--
+		return
+	}
+
+	if p, found := e.registry[id]; found && p.internKey != "" && e.interned[p.internKey] == id {
+		delete(e.interned, p.internKey)
+	}
+	delete(e.refs, id)
+	delete(e.registry, id)
+}
+
+func (e *evaluator) dropAll() {
+	e.mutex.Lock()
+	e.registry = make(map[uint64]*policy)
+	e.interned = make(map[string]uint64)
+	e.refs = make(map[uint64]int)
+	e.mutex.Unlock()
+}
+
+// RegoReplaceModule recompiles the query id from query and a single module,
+// keeping its id, its data and the options it was created with, such as the
+// builtins forbidden by RegoNewRestricted or the runtime given to
+// RegoNewWithRuntime, so callers holding the id pick up the new policy on
+// their next evaluation. If compilation fails, the previous policy is left in
+// place and the error is returned. Evaluations already in flight finish
+// against the previous policy.
+//
+//export RegoReplaceModule
+func RegoReplaceModule(id uint64, query string, modulename string, modulecontent string) *C.char {
+	ctx := context.Background()
+
+	old, err := defaultEvaluator.lookup(id)
+	if err != nil {
+		return cError(err)
+	}
+
+	p, err := newPolicyWithOptions(ctx, old.store, old.options.compiler(), old.options,
+		rego.Query(query),
+		rego.Module(clone(modulename), modulecontent),
+	)
+	if err != nil {
+		return cError(err)
+	}
+	p.revision = old.revision
+
+	err = defaultEvaluator.update(id, func(current *policy) *policy {
+		p.logDecisions = current.logDecisions
+		return p
+	})
+	if err != nil {
+		return cError(err)
+	}
+
+	return nil
+}
+
+// RegoNewInterned is like RegoNew, but if a query with the same query,
+// modulename and modulecontent was already created this way and not yet
+// dropped, it returns that query's id instead of compiling it again. Each call
+// adds a reference, and the query is only dropped once RegoDrop has been
+// called once per reference. Interned queries share their data, so
+// RegoSetData on one is seen by every holder of the id; replacing the module
+// with RegoReplaceModule stops the id from being shared with later callers.
+//
+//export RegoNewInterned
+func RegoNewInterned(query string, modulename string, modulecontent string) (uint64, *C.char) {
+	ctx := context.Background()
+
+	h := sha256.New()
+	for _, s := range []string{query, modulename, modulecontent} {
+		fmt.Fprintf(h, "%d:%s", len(s), s)
+	}
+	key := hex.EncodeToString(h.Sum(nil))
+
+	if id, found := defaultEvaluator.acquire(key); found {
+		return id, nil
+	}
+
+	p, err := newPolicy(ctx, inmem.New(), newCompiler(),
+		rego.Query(query),
+		rego.Module(clone(modulename), modulecontent),
+	)
+	if err != nil {
+		return 0, cError(err)
+	}
+	p.internKey = key
+
+	id, err := defaultEvaluator.registerInterned(p)
+	if err != nil {
+		return 0, cError(err)
+	}
+
+	return id, nil
+}
+
+// RegoRetain adds a reference to the query with the given id. Each RegoNew
+// call (or equivalent) holds one reference, and the query stays registered
+// until RegoDrop has been called once per reference. Evaluations already in
+// flight when the last reference is dropped still run to completion.
+//
+//export RegoRetain
+func RegoRetain(id uint64) *C.char {
+	if err := defaultEvaluator.retain(id); err != nil {
+		return cError(err)
+	}
+
+	return nil
+}
+
+//export RegoDrop
+func RegoDrop(id uint64) {
+	defaultEvaluator.drop(id)
+}
+
+// RegoListIds returns the ids of every registered query as a JSON array in
+// ascending order.
+//
+//export RegoListIds
+func RegoListIds() (*C.char, *C.char) {
+	jbytes, err := json.Marshal(defaultEvaluator.list())
+	if err != nil {
+		return nil, cError(err)
+	}
+
+	return C.CString(string(jbytes)), nil
+}
+
+// RegoCount returns the number of registered queries.
+//
+//export RegoCount
+func RegoCount() C.longlong {
+	return C.longlong(defaultEvaluator.count())
+}
+
+// RegoDropAll drops every query. As with RegoDrop, evaluations already in
+// flight finish normally.
+//
+//export RegoDropAll
+func RegoDropAll() {
+	defaultEvaluator.dropAll()
+}
+
+//export RegoEvalBool
+func RegoEvalBool(id uint64, inputstr string) (bool, *C.char) {
+	ctx := context.Background()
+
+	results, err := eval(ctx, id, inputstr)
+	if err != nil {
+		return false, cError(err)
+	}
+
+	if b, ok := firstValue(results).(bool); ok {
+		return b, nil
+	} else {
+		return false, nil
+	}
+}
+
+// RegoEvalBoolStrict is like RegoEvalBool, but reports whether the query
+// produced exactly one result whose value is a boolean. An undefined query,
+// a non-boolean value, or multiple results return isBool false.
+//
+//export RegoEvalBoolStrict
+func RegoEvalBoolStrict(id uint64, inputstr string) (bool, bool, *C.char) {
+	ctx := context.Background()
+
+	results, err := eval(ctx, id, inputstr)
+	if err != nil {
+		return false, false, cError(err)
+	}
+
+	if len(results) != 1 {
+		return false, false, nil
+	}
+
+	b, ok := firstValue(results).(bool)
+	return b, ok, nil
+}
+
+// RegoEvalBoolDefined is like RegoEvalBool, but also reports whether the
+// query was defined, so that an undefined decision can be told apart from
+// false.
+//
+//export RegoEvalBoolDefined
+func RegoEvalBoolDefined(id uint64, inputstr string) (bool, bool, *C.char) {
+	ctx := context.Background()
+
+	results, err := eval(ctx, id, inputstr)
+	if err != nil {
+		return false, false, cError(err)
+	}
+
+	if len(results) == 0 || len(results[0].Expressions) == 0 {
+		return false, false, nil
+	}
+
+	b, _ := firstValue(results).(bool)
+	return b, true, nil
+}
+
+// RegoEvalString returns the first expression value of the first result when
+// it is a string. An undefined or non-string result returns nil with no error.
+//
+//export RegoEvalString
+func RegoEvalString(id uint64, inputstr string) (*C.char, *C.char) {
+	ctx := context.Background()
+
+	results, err := eval(ctx, id, inputstr)
+	if err != nil {
+		return nil, cError(err)
+	}
+
+	if s, ok := firstValue(results).(string); ok {
+		return C.CString(s), nil
+	} else {
+		return nil, nil
+	}
+}
+
+// RegoEvalFloat returns the first expression value of the first result when
+// it is a number, along with whether it was defined.
+//
+//export RegoEvalFloat
+func RegoEvalFloat(id uint64, inputstr string) (C.double, bool, *C.char) {
+	ctx := context.Background()
+
+	results, err := eval(ctx, id, inputstr)
+	if err != nil {
+		return 0, false, cError(err)
+	}
+
+	if f, ok := floatValue(firstValue(results)); ok {
+		return C.double(f), true, nil
+	} else {
+		return 0, false, nil
+	}
+}
+
+// RegoEvalInt is like RegoEvalFloat, but a number with a fractional part (or
+// one that does not fit in 64 bits) is reported as undefined rather than
+// truncated.
+//
+//export RegoEvalInt
+func RegoEvalInt(id uint64, inputstr string) (C.longlong, bool, *C.char) {
+	ctx := context.Background()
+
+	results, err := eval(ctx, id, inputstr)
+	if err != nil {
+		return 0, false, cError(err)
+	}
+
+	if i, ok := intValue(firstValue(results)); ok {
+		return C.longlong(i), true, nil
+	} else {
+		return 0, false, nil
+	}
+}
+
+// RegoEvalCount returns the number of results the query produces without
+// marshaling them.
+//
+//export RegoEvalCount
+func RegoEvalCount(id uint64, inputstr string) (C.longlong, *C.char) {
+	ctx := context.Background()
+
+	results, err := eval(ctx, id, inputstr)
+	if err != nil {
+		return 0, cError(err)
+	}
+
+	return C.longlong(len(results)), nil
+}
+
+//export RegoEval
+func RegoEval(id uint64, inputstr string) (*C.char, *C.char) {
+	ctx := context.Background()
+
+	jbytes, err := evalJSON(ctx, id, inputstr)
+	if err != nil {
+		return nil, cError(err)
+	}
+
+	return C.CString(string(jbytes)), nil
+}
+
+// RegoEvalNoInput is like RegoEval, but evaluates without any input, so that
+// input is undefined rather than an empty object or null.
+//
+//export RegoEvalNoInput
+func RegoEvalNoInput(id uint64) (*C.char, *C.char) {
+	ctx := context.Background()
+
+	results, err := evalInput(ctx, id, noInput{})
+	if err != nil {
+		return nil, cError(err)
+	}
+
+	return resultsCString(results)
+}
+
+// RegoWarmup evaluates the query once without input and discards the result,
+// so that the cost of a first evaluation is paid up front rather than by the
+// first real request. RegoNew already parses and compiles the modules, builds
+// the rule indices and plans the query, so what this warms is limited to what
+// evaluation itself initializes lazily: the Go runtime's memory for the
+// evaluator, and the caches builtins fill on first use, such as compiled
+// regular expressions and glob patterns. Only the rules reached without input
+// are evaluated, so rules guarded by input are not warmed. The evaluation is
+// not decision logged. It returns an error if the evaluation fails.
+//
+//export RegoWarmup
+func RegoWarmup(id uint64) *C.char {
+	ctx := context.Background()
+
+	p, err := defaultEvaluator.lookup(id)
+	if err != nil {
+		return cError(err)
+	}
+
+	_, err = p.query.Eval(ctx)
+	if err != nil {
+		return cError(withCode(codeEval, err))
+	}
+
+	return nil
+}
+
+// inputs holds the inputs parsed by RegoParseInput, keyed by token.
+var (
+	inputs            = make(map[uint64]ast.Value)
+	inputMutex        = &sync.RWMutex{}
+	inputIds   uint64 = 0
+)
+
+var errInputNotFound = withCode(codeNotFound, errors.New("could not find input"))
+
+// RegoParseInput parses the input JSON once and returns a token for it, which
+// can be passed to RegoEvalWithInputToken to evaluate any number of queries
+// against the input without parsing it again. The token stays valid until
+// RegoDropInput is called.
+//
+//export RegoParseInput
+func RegoParseInput(inputstr string) (uint64, *C.char) {
+	value, err := parseInputValue(inputstr)
+	if err != nil {
+		return 0, cError(err)
+	}
+
+	inputMutex.Lock()
+	inputIds += 1
+	var token = inputIds
+	inputs[token] = value
+	inputMutex.Unlock()
+
+	return token, nil
+}
+
+// RegoEvalWithInputToken is like RegoEval, but evaluates against the input
+// parsed by RegoParseInput.
+//
+//export RegoEvalWithInputToken
+func RegoEvalWithInputToken(id uint64, inputToken uint64) (*C.char, *C.char) {
+	ctx := context.Background()
+
+	inputMutex.RLock()
+	input, found := inputs[inputToken]
+	inputMutex.RUnlock()
+
+	if !found {
+		return nil, cError(errInputNotFound)
+	}
+
+	results, err := evalInput(ctx, id, input)
+	if err != nil {
+		return nil, cError(err)
+	}
+
+	return resultsCString(results)
+}
+
+// RegoDropInput releases the input parsed by RegoParseInput.
+//
+//export RegoDropInput
+func RegoDropInput(inputToken uint64) {
+	inputMutex.Lock()
+	delete(inputs, inputToken)
+	inputMutex.Unlock()
+}
+
+// RegoEvalBytesInput is like RegoEval, but reads the input JSON from the
+// inputLen bytes at inputPtr rather than from a string.
+//
+//export RegoEvalBytesInput
+func RegoEvalBytesInput(id uint64, inputPtr unsafe.Pointer, inputLen int) (*C.char, *C.char) {
+	ctx := context.Background()
+
+	if inputLen < 0 {
+		return nil, cError(invalidArgument("input length must not be negative, got %d", inputLen))
+	}
+
+	var input interface{}
+	err := util.UnmarshalJSON(C.GoBytes(inputPtr, C.int(inputLen)), &input)
+	if err != nil {
+		return nil, cError(withCode(codeInvalidInput, err))
+	}
+
+	results, err := evalInput(ctx, id, input)
+	if err != nil {
+		return nil, cError(err)
+	}
+
+	return resultsCString(results)
+}
+
+// RegoEvalAtPath is like RegoEval, but places the input at the
+// slash-separated path under input rather than replacing the whole input
+// document; with path "/request", the input is available as input.request.
+//
+//export RegoEvalAtPath
+func RegoEvalAtPath(id uint64, path string, inputstr string) (*C.char, *C.char) {
+	ctx := context.Background()
+
+	inputPath, ok := storage.ParsePath(path)
+	if !ok {
+		return nil, cError(invalidArgument("invalid input path %q", path))
+	}
+
+	input, err := parseInput(inputstr)
+	if err != nil {
+		return nil, cError(err)
+	}
+
+	for i := len(inputPath) - 1; i >= 0; i-- {
+		input = map[string]interface{}{inputPath[i]: input}
+	}
+
+	results, err := evalInput(ctx, id, input)
+	if err != nil {
+		return nil, cError(err)
+	}
+
+	return resultsCString(results)
+}
+
+// RegoEvalWithOverlay is like RegoEval, but first deep-merges the JSON value
+// overlayJSON onto the input: objects are merged key by key, and any other
+// value in the overlay, including null and arrays, replaces the input's value
+// at the same place. With the overlay {"user": {"role": "admin"}}, only
+// input.user.role is changed.
+//
+//export RegoEvalWithOverlay
+func RegoEvalWithOverlay(id uint64, inputstr string, overlayJSON string) (*C.char, *C.char) {
+	ctx := context.Background()
+
+	input, err := parseInput(inputstr)
+	if err != nil {
+		return nil, cError(err)
+	}
+
+	overlay, err := parseInput(overlayJSON)
+	if err != nil {
+		return nil, cError(err)
+	}
+
+	results, err := evalInput(ctx, id, overlayValue(input, overlay))
+	if err != nil {
+		return nil, cError(err)
+	}
+
+	return resultsCString(results)
+}
+
+// overlayValue returns overlay deep-merged onto base. It modifies base.
+func overlayValue(base, overlay interface{}) interface{} {
+	baseObj, ok1 := base.(map[string]interface{})
+	overlayObj, ok2 := overlay.(map[string]interface{})
+	if !ok1 || !ok2 {
+		return overlay
+	}
+
+	for k, v := range overlayObj {
+		baseObj[k] = overlayValue(baseObj[k], v)
+	}
+
+	return baseObj
+}
+
+// RegoEvalPath evaluates the document at dataPath, rather than the query the
+// id was prepared with, against the query's modules and data. The path is
+// either slash-separated ("/example/allow") or a reference, with or without
+// the leading data ("data.example.allow" or "example.allow"); an empty path
+// evaluates the whole data document. It returns the result set in the same
+// form as RegoEval. The id may be prepared with any query, e.g. "data", as
+// only its modules and data are used.
+//
+// The query for dataPath is planned on every call, which reuses the compiled
+// modules and so is cheap, but is slower than evaluating a prepared query.
+//
+//export RegoEvalPath
+func RegoEvalPath(id uint64, dataPath string, inputstr string) (*C.char, *C.char) {
+	ctx := context.Background()
+
+	input, err := parseInput(inputstr)
+	if err != nil {
+		return nil, cError(err)
+	}
+
+	results, err := evalPath(ctx, id, dataPath, input)
+	if err != nil {
+		return nil, cError(err)
+	}
+
+	return resultsCString(results)
+}
+
+// dataRequest is the body of a request to OPA's data API.
+type dataRequest struct {
+	Input *interface{} `json:"input"`
+}
+
+// dataResponse is the body of a response from OPA's data API.
+type dataResponse struct {
+	Result *interface{} `json:"result,omitempty"`
+}
+
+// newDataResponse returns the value of the first expression of the first
+// result as a data API response, without a result if the query is undefined.
+func newDataResponse(results rego.ResultSet) dataResponse {
+	var response dataResponse
+	if len(results) > 0 && len(results[0].Expressions) > 0 {
+		response.Result = &results[0].Expressions[0].Value
+	}
+	return response
+}
+
+// RegoDataQuery evaluates the document at path like RegoEvalPath, but takes
+// and returns the same bodies as a POST to OPA's data API: requestJSON is
+// {"input": ...}, and the result is {"result": ...}, or {} if the document is
+// undefined. If requestJSON is empty or has no input, input is undefined.
+//
+//export RegoDataQuery
+func RegoDataQuery(id uint64, path string, requestJSON string) (*C.char, *C.char) {
+	ctx := context.Background()
+
+	var request dataRequest
+	if strings.TrimSpace(requestJSON) != "" {
+		err := util.UnmarshalJSON([]byte(requestJSON), &request)
+		if err != nil {
+			return nil, cError(withCode(codeInvalidInput, err))
+		}
+	}
+
+	var input interface{} = noInput{}
+	if request.Input != nil {
+		input = *request.Input
+	}
+
+	results, err := evalPath(ctx, id, path, input)
+	if err != nil {
+		return nil, cError(err)
+	}
+
+	jbytes, err := json.Marshal(newDataResponse(results))
+	if err != nil {
+		return nil, cError(err)
+	}
+
+	return C.CString(string(jbytes)), nil
+}
+
+// defaultDecision is the path of the decision OPA evaluates for requests that
+// do not name one, unless configured otherwise.
+const defaultDecision = "/system/main"
+
+// RegoEvalDefault evaluates the default decision, data.system.main, in the
+// same way as RegoDataQuery, and returns {"result": ...}, or {} if it is
+// undefined. The embedded OPA's bundle manifests only declare a revision and
+// roots, not an entrypoint, so, like opa run, this uses OPA's default
+// default_decision rather than reading it from the bundle.
+//
+//export RegoEvalDefault
+func RegoEvalDefault(id uint64, inputstr string) (*C.char, *C.char) {
+	ctx := context.Background()
+
+	input, err := parseInput(inputstr)
+	if err != nil {
+		return nil, cError(err)
+	}
+
+	results, err := evalPath(ctx, id, defaultDecision, input)
+	if err != nil {
+		return nil, cError(err)
+	}
+
+	jbytes, err := json.Marshal(newDataResponse(results))
+	if err != nil {
+		return nil, cError(err)
+	}
+
+	return C.CString(string(jbytes)), nil
+}
+
+// evalPath evaluates the document at path against the modules, data and
+// prepare options of query id.
+func evalPath(ctx context.Context, id uint64, path string, input interface{}) (rego.ResultSet, error) {
+	ref, err := dataRef(path)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := defaultEvaluator.lookup(id)
+	if err != nil {
+		return nil, err
+	}
+
+	p.prepareMutex.Lock()
+	pathPolicy, err := newPolicyWithOptions(ctx, p.store, p.compiler, p.options, rego.Query(ref.String()))
+	p.prepareMutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	pathPolicy.logDecisions = p.logDecisions
+
+	return pathPolicy.eval(ctx, id, input)
+}
+
+// dataRef returns the reference to the document at path, which is either
+// slash-separated or a reference, with or without the leading data.
+func dataRef(path string) (ast.Ref, error) {
+	if path == "" || strings.Contains(path, "/") {
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+
+		storagePath, ok := storage.ParsePath(path)
+		if !ok {
+			return nil, invalidArgument("invalid data path %q", path)
+		}
+
+		ref := ast.Ref{ast.DefaultRootDocument}
+		for _, key := range storagePath {
+			ref = ref.Append(ast.StringTerm(key))
+		}
+
+		return ref, nil
+	}
+
+	ref, err := ast.ParseRef(path)
+	if err != nil {
+		return nil, invalidArgument("invalid data path %q: %v", path, err)
+	}
+
+	if !ref[0].Equal(ast.DefaultRootDocument) {
+		ref, err = ast.ParseRef("data." + path)
+		if err != nil {
+			return nil, invalidArgument("invalid data path %q: %v", path, err)
+		}
+	}
+
+	return ref, nil
+}
+
+// RegoEvalRuleValue returns the first expression value of the first result as
+// JSON, without the surrounding result set, or "null" if it is undefined.
+//
+//export RegoEvalRuleValue
+func RegoEvalRuleValue(id uint64, inputstr string) (*C.char, *C.char) {
+	ctx := context.Background()
+
+	results, err := eval(ctx, id, inputstr)
+	if err != nil {
+		return nil, cError(err)
+	}
+
+	jbytes, err := json.Marshal(firstValue(results))
+	if err != nil {
+		return nil, cError(err)
+	}
+
+	return C.CString(string(jbytes)), nil
+}
+
+// RegoEvalExpressions returns the values of every expression of every result
+// as JSON, one array of values per result, in the order the expressions appear
+// in the query. For the query "a = data.x; b = data.y" with one result, it is
+// [[true, true]]; an undefined query gives [].
+//
+//export RegoEvalExpressions
+func RegoEvalExpressions(id uint64, inputstr string) (*C.char, *C.char) {
+	ctx := context.Background()
+
+	results, err := eval(ctx, id, inputstr)
+	if err != nil {
+		return nil, cError(err)
+	}
+
+	values := make([][]interface{}, len(results))
+	for i, result := range results {
+		values[i] = make([]interface{}, len(result.Expressions))
+		for j, expr := range result.Expressions {
+			values[i][j] = expr.Value
+		}
+	}
+
+	jbytes, err := json.Marshal(values)
+	if err != nil {
+		return nil, cError(err)
+	}
+
+	return C.CString(string(jbytes)), nil
+}
+
+// RegoEvalDecision is like RegoEvalRuleValue, but wraps the value in the same
+// envelope as OPA's data API, {"result": ...}, and returns {} if it is
+// undefined. Unlike RegoEvalRuleValue, this tells an undefined decision apart
+// from one whose value is null, false or empty.
+//
+//export RegoEvalDecision
+func RegoEvalDecision(id uint64, inputstr string) (*C.char, *C.char) {
+	ctx := context.Background()
+
+	results, err := eval(ctx, id, inputstr)
+	if err != nil {
+		return nil, cError(err)
+	}
+
+	jbytes, err := json.Marshal(newDataResponse(results))
+	if err != nil {
+		return nil, cError(err)
+	}
+
+	return C.CString(string(jbytes)), nil
+}
+
+// provenance describes what produced a decision, in the same form as the
+// provenance OPA's REST API attaches to responses.
+type provenance struct {
+	Version   string `json:"version"`
+	Vcs       string `json:"build_commit"`
+	Timestamp string `json:"build_timestamp"`
+	Hostname  string `json:"build_hostname"`
+	Revision  string `json:"revision,omitempty"`
+}
+
+// RegoEvalWithProvenance is like RegoEval, but also returns the provenance of
+// the decision as a JSON object: the version and build of the embedded OPA,
+// and, for queries created by RegoNewFromBundle, the revision in the bundle's
+// manifest.
+//
+//export RegoEvalWithProvenance
+func RegoEvalWithProvenance(id uint64, inputstr string) (*C.char, *C.char, *C.char) {
+	ctx := context.Background()
+
+	p, err := defaultEvaluator.lookup(id)
+	if err != nil {
+		return nil, nil, cError(err)
+	}
+
+	input, err := parseInput(inputstr)
+	if err != nil {
+		return nil, nil, cError(err)
+	}
+
+	results, err := p.eval(ctx, id, input)
+	if err != nil {
+		return nil, nil, cError(err)
+	}
+
+	jbytes, err := json.Marshal(results)
+	if err != nil {
+		return nil, nil, cError(err)
+	}
+
+	pbytes, err := json.Marshal(provenance{
+		Version:   version.Version,
+		Vcs:       version.Vcs,
+		Timestamp: version.Timestamp,
+		Hostname:  version.Hostname,
+		Revision:  p.revision,
+	})
+	if err != nil {
+		return nil, nil, cError(err)
+	}
+
+	return C.CString(string(jbytes)), C.CString(string(pbytes)), nil
+}
+
+// RegoEvalObject is like RegoEvalRuleValue, but fails with an "eval_error"
+// unless the value is a JSON object, so the result is always an object or
+// "null" if it is undefined.
+//
+//export RegoEvalObject
+func RegoEvalObject(id uint64, inputstr string) (*C.char, *C.char) {
+	ctx := context.Background()
+
+	results, err := eval(ctx, id, inputstr)
+	if err != nil {
+		return nil, cError(err)
+	}
+
+	value := firstValue(results)
+
+	jbytes, err := json.Marshal(value)
+	if err != nil {
+		return nil, cError(err)
+	}
+
+	if _, ok := value.(map[string]interface{}); value != nil && !ok {
+		return nil, cError(withCode(codeEval, fmt.Errorf("query result is not an object: %s", jbytes)))
+	}
+
+	return C.CString(string(jbytes)), nil
+}
+
+// RegoEvalPage is like RegoEval, but returns at most limit results starting
+// at offset, along with the offset of the next page, or -1 if there are no
+// more results. Results are in OPA's evaluation order, which is stable for a
+// given query, policy, data and input. Each call evaluates the query again, so
+// this bounds the size of the JSON returned rather than the work done.
+//
+//export RegoEvalPage
+func RegoEvalPage(id uint64, inputstr string, offset int64, limit int64) (*C.char, C.longlong, *C.char) {
+	ctx := context.Background()
+
+	if offset < 0 || limit <= 0 {
+		return nil, -1, cError(invalidArgument("invalid page: offset %d, limit %d", offset, limit))
+	}
+
+	results, err := eval(ctx, id, inputstr)
+	if err != nil {
+		return nil, -1, cError(err)
+	}
+
+	page := rego.ResultSet{}
+	next := int64(-1)
+	if offset < int64(len(results)) {
+		end := int64(len(results))
+		if limit < end-offset {
+			end = offset + limit
+			next = end
+		}
+		page = results[offset:end]
+	}
+
+	jbytes, err := json.Marshal(page)
+	if err != nil {
+		return nil, -1, cError(err)
+	}
+
+	return C.CString(string(jbytes)), C.longlong(next), nil
+}
+
+// RegoEvalFirstResult returns the first result as a JSON object with its
+// expressions and bindings, or "null" if the query is undefined.
+//
+//export RegoEvalFirstResult
+func RegoEvalFirstResult(id uint64, inputstr string) (*C.char, *C.char) {
+	ctx := context.Background()
+
+	results, err := eval(ctx, id, inputstr)
+	if err != nil {
+		return nil, cError(err)
+	}
+
+	var first *rego.Result
+	if len(results) > 0 {
+		first = &results[0]
+	}
+
+	jbytes, err := json.Marshal(first)
+	if err != nil {
+		return nil, cError(err)
+	}
+
+	return C.CString(string(jbytes)), nil
+}
+
+// RegoEvalBindings returns the variable bindings of each result as a JSON
+// array of objects. The order of the results follows OPA's evaluation order,
+// which depends on the query and policy and is not otherwise guaranteed.
+//
+//export RegoEvalBindings
+func RegoEvalBindings(id uint64, inputstr string) (*C.char, *C.char) {
+	ctx := context.Background()
+
+	results, err := eval(ctx, id, inputstr)
+	if err != nil {
+		return nil, cError(err)
+	}
+
+	bindings := make([]rego.Vars, len(results))
+	for i := range results {
+		bindings[i] = results[i].Bindings
+		if bindings[i] == nil {
+			bindings[i] = rego.Vars{}
+		}
+	}
+
+	jbytes, err := json.Marshal(bindings)
+	if err != nil {
+		return nil, cError(err)
+	}
+
+	return C.CString(string(jbytes)), nil
+}
+
+// RegoEvalBytes is like RegoEval, but returns the results as a byte buffer
+// and its length rather than a NUL-terminated string, so results containing
+// "\u0000" survive intact. The buffer must be released with Free.
+//
+//export RegoEvalBytes
+func RegoEvalBytes(id uint64, inputstr string) (unsafe.Pointer, int, *C.char) {
+	ctx := context.Background()
+
+	jbytes, err := evalJSON(ctx, id, inputstr)
+	if err != nil {
+		return nil, 0, cError(err)
+	}
+
+	return C.CBytes(jbytes), len(jbytes), nil
+}
+
+// RegoEvalWithTimeout is like RegoEval, but cancels the evaluation once
+// timeoutMillis have passed, failing with a "timeout" error. As with
+// RegoEvalWithLimits, a timeout of 0 or less disables it.
+//
+//export RegoEvalWithTimeout
+func RegoEvalWithTimeout(id uint64, inputstr string, timeoutMillis int64) (*C.char, *C.char) {
+	ctx := context.Background()
+
+	if timeoutMillis > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(timeoutMillis)*time.Millisecond)
+		defer cancel()
+	}
+
+	jbytes, err := evalJSON(ctx, id, inputstr)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			err = withCode(codeTimeout, err)
+		}
+		return nil, cError(err)
+	}
+
+	return C.CString(string(jbytes)), nil
+}
+
+// RegoEvalWithLimits is like RegoEval, but aborts the evaluation once it runs
+// for timeoutMillis, failing with a "timeout" error, or takes more than
+// maxSteps evaluation steps, failing with a "resource_limit" error. A limit of
+// 0 disables that check.
+//
+// A step is one event in OPA's evaluation trace, such as evaluating an
+// expression or entering a rule, so the step count bounds the work done by
+// runaway comprehensions and recursion. Counting steps slows evaluation down.
+// OPA cannot cap memory: a single step that builds a huge value, such as a
+// builtin call on large input, is not interrupted. Aborts take effect at the
+// evaluator's next cancellation check, so a few more steps may run.
+//
+//export RegoEvalWithLimits
+func RegoEvalWithLimits(id uint64, inputstr string, timeoutMillis int64, maxSteps int64) (*C.char, *C.char) {
+	ctx := context.Background()
+
+	if timeoutMillis > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(timeoutMillis)*time.Millisecond)
+		defer cancel()
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var evalArgs []rego.EvalOption
+	limiter := &stepLimiter{max: maxSteps, cancel: cancel}
+	if maxSteps > 0 {
+		evalArgs = append(evalArgs, rego.EvalTracer(limiter))
+	}
+
+	results, err := eval(ctx, id, inputstr, evalArgs...)
+	if err != nil {
+		if limiter.exceeded {
+			err = withCode(codeResourceLimit, fmt.Errorf("evaluation exceeded %d steps", maxSteps))
+		} else if ctx.Err() == context.DeadlineExceeded {
+			err = withCode(codeTimeout, err)
+		}
+		return nil, cError(err)
+	}
+
+	return resultsCString(results)
+}
+
+// stepLimiter is a tracer that cancels the evaluation once it has seen more
+// than max events.
+type stepLimiter struct {
+	max      int64
+	steps    int64
+	exceeded bool
+	cancel   context.CancelFunc
+}
+
+func (l *stepLimiter) Enabled() bool {
+	return true
+}
+
+func (l *stepLimiter) Trace(*topdown.Event) {
+	l.steps++
+	if l.steps > l.max && !l.exceeded {
+		l.exceeded = true
+		l.cancel()
+	}
+}
+
+// RegoNewCancel returns a cancellation token for use with a single call to
+// RegoEvalCancellable, which releases it. A token that ends up unused must be
+// released with RegoReleaseCancel.
+//
+//export RegoNewCancel
+func RegoNewCancel() uint64 {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	cancelMutex.Lock()
+	cancelIds += 1
+	var token = cancelIds
+	cancels[token] = cancelContext{ctx, cancel}
+	cancelMutex.Unlock()
+
+	return token
+}
+
+// RegoCancel cancels the evaluation using cancelToken. If it has not started
+// yet, it fails as soon as it does; if it has already finished, this does
+// nothing.
+//
+//export RegoCancel
+func RegoCancel(cancelToken uint64) {
+	cancelMutex.Lock()
+	c, found := cancels[cancelToken]
+	cancelMutex.Unlock()
+
+	if found {
+		c.cancel()
+	}
+}
+
+// RegoReleaseCancel releases cancelToken without using it. It does nothing if
+// the token was already released.
+//
+//export RegoReleaseCancel
+func RegoReleaseCancel(cancelToken uint64) {
+	cancelMutex.Lock()
+	c, found := cancels[cancelToken]
+	delete(cancels, cancelToken)
+	cancelMutex.Unlock()
+
+	if found {
+		c.cancel()
+	}
+}
+
+// RegoEvalCancellable is like RegoEval, but stops when cancelToken is
+// cancelled, failing with a "canceled" error.
+// The token is released once the evaluation returns.
+//
+//export RegoEvalCancellable
+func RegoEvalCancellable(id uint64, inputstr string, cancelToken uint64) (*C.char, *C.char) {
+	cancelMutex.Lock()
+	c, found := cancels[cancelToken]
+	cancelMutex.Unlock()
+
+	if !found {
+		return nil, cError(withCode(codeNotFound, errors.New("could not find cancel token")))
+	}
+
+	defer func() {
+		cancelMutex.Lock()
+		delete(cancels, cancelToken)
+		cancelMutex.Unlock()
+		c.cancel()
+	}()
+
+	jbytes, err := evalJSON(c.ctx, id, inputstr)
+	if err != nil {
+		if c.ctx.Err() == context.Canceled {
+			err = withCode(codeCanceled, err)
+		}
+		return nil, cError(err)
+	}
+
+	return C.CString(string(jbytes)), nil
+}
+
+// traceIDKey is the context key of the trace id passed to RegoEvalTraced.
+type traceIDKey struct{}
+
+// RegoEvalTraced is like RegoEval, but tags the evaluation with traceID, so
+// that its decision log entry carries it as "traceId" and can be correlated
+// with the request that caused it. Only the decision log sees the trace id:
+// the builtin callback receives just the builtin's arguments, and trace()
+// notes and print output are not tagged.
+//
+//export RegoEvalTraced
+func RegoEvalTraced(id uint64, inputstr string, traceID string) (*C.char, *C.char) {
+	ctx := context.WithValue(context.Background(), traceIDKey{}, traceID)
+
+	jbytes, err := evalJSON(ctx, id, inputstr)
+	if err != nil {
+		return nil, cError(err)
+	}
+
+	return C.CString(string(jbytes)), nil
+}
+
+// RegoEvalWithMetrics is like RegoEval, but also returns the timers and
+// counters OPA collected during the evaluation as a JSON object.
+//
+//export RegoEvalWithMetrics
+func RegoEvalWithMetrics(id uint64, inputstr string) (*C.char, *C.char, *C.char) {
+	ctx := context.Background()
+	m := metrics.New()
+
+	results, err := eval(ctx, id, inputstr, rego.EvalMetrics(m))
+	if err != nil {
+		return nil, nil, cError(err)
+	}
+
+	jbytes, err := json.Marshal(results)
+	if err != nil {
+		return nil, nil, cError(err)
+	}
+
+	mbytes, err := json.Marshal(m.All())
+	if err != nil {
+		return nil, nil, cError(err)
+	}
+
+	return C.CString(string(jbytes)), C.CString(string(mbytes)), nil
+}
+
+// RegoEvalInstrumented is like RegoEvalWithMetrics, but also enables OPA's
+// instrumentation, which adds detailed timers for the evaluator's internal
+// operations such as eval_op_plug. Instrumentation slows evaluation down
+// noticeably, so it is only meant for profiling.
+//
+//export RegoEvalInstrumented
+func RegoEvalInstrumented(id uint64, inputstr string) (*C.char, *C.char, *C.char) {
+	ctx := context.Background()
+	m := metrics.New()
+
+	results, err := eval(ctx, id, inputstr, rego.EvalMetrics(m), rego.EvalInstrument(true))
+	if err != nil {
+		return nil, nil, cError(err)
+	}
+
+	jbytes, err := json.Marshal(results)
+	if err != nil {
+		return nil, nil, cError(err)
+	}
+
+	mbytes, err := json.Marshal(m.All())
+	if err != nil {
+		return nil, nil, cError(err)
+	}
+
+	return C.CString(string(jbytes)), C.CString(string(mbytes)), nil
+}
+
+// Explanation levels accepted by RegoEvalExplain.
+const (
+	explainFull = iota
+	explainNotes
+	explainFails
+)
+
+// RegoEvalExplain is like RegoEval, but also returns a trace of the
+// evaluation as a JSON array of events, in the same format as the explain
+// output of OPA's REST API. level selects the events to keep: 0 for every
+// event, 1 for calls to trace() and 2 for failed expressions, each with the
+// events leading up to them.
+//
+//export RegoEvalExplain
+func RegoEvalExplain(id uint64, inputstr string, level int) (*C.char, *C.char, *C.char) {
+	ctx := context.Background()
+	buf := topdown.NewBufferTracer()
+
+	results, err := eval(ctx, id, inputstr, rego.EvalTracer(buf))
+	if err != nil {
+		return nil, nil, cError(err)
+	}
+
+	var events []*topdown.Event
+	switch level {
+	case explainFull:
+		events = []*topdown.Event(*buf)
+	case explainNotes:
+		events = lineage.Notes(*buf)
+	case explainFails:
+		events = lineage.Fails(*buf)
+	default:
+		return nil, nil, cError(invalidArgument("unknown explanation level %d", level))
+	}
+
+	jbytes, err := json.Marshal(results)
+	if err != nil {
+		return nil, nil, cError(err)
+	}
+
+	trace, err := servertypes.NewTraceV1(events, false)
+	if err != nil {
+		return nil, nil, cError(err)
+	}
+
+	return C.CString(string(jbytes)), C.CString(string(trace)), nil
+}
+
+// note is a message a policy emitted with trace().
+type note struct {
+	Message  string        `json:"message"`
+	Location *ast.Location `json:"location,omitempty"`
+}
+
+// RegoEvalWithPrints is like RegoEval, but also returns the messages the
+// policy emitted as a JSON array of {"message", "location"} objects, in the
+// order they were emitted. The embedded OPA predates the print() builtin, so
+// messages are emitted with trace(), which is always enabled.
+//
+//export RegoEvalWithPrints
+func RegoEvalWithPrints(id uint64, inputstr string) (*C.char, *C.char, *C.char) {
+	ctx := context.Background()
+	buf := topdown.NewBufferTracer()
+
+	results, err := eval(ctx, id, inputstr, rego.EvalTracer(buf))
+	if err != nil {
+		return nil, nil, cError(err)
+	}
+
+	notes := []note{}
+	for _, e := range *buf {
+		if e.Op == topdown.NoteOp {
+			notes = append(notes, note{e.Message, e.Location})
+		}
+	}
+
+	jbytes, err := json.Marshal(results)
+	if err != nil {
+		return nil, nil, cError(err)
+	}
+
+	nbytes, err := json.Marshal(notes)
+	if err != nil {
+		return nil, nil, cError(err)
+	}
+
+	return C.CString(string(jbytes)), C.CString(string(nbytes)), nil
+}
+
+// RegoEvalWithCoverage is like RegoEval, but also returns a JSON coverage
+// report of the query's modules, listing the lines that were and were not
+// evaluated.
+//
+//export RegoEvalWithCoverage
+func RegoEvalWithCoverage(id uint64, inputstr string) (*C.char, *C.char, *C.char) {
+	ctx := context.Background()
+	cov := cover.New()
+
+	p, err := defaultEvaluator.lookup(id)
+	if err != nil {
+		return nil, nil, cError(err)
+	}
+
+	results, err := eval(ctx, id, inputstr, rego.EvalTracer(cov))
+	if err != nil {
+		return nil, nil, cError(err)
+	}
+
+	jbytes, err := json.Marshal(results)
+	if err != nil {
+		return nil, nil, cError(err)
+	}
+
+	cbytes, err := json.Marshal(cov.Report(p.compiler.Modules))
+	if err != nil {
+		return nil, nil, cError(err)
+	}
+
+	return C.CString(string(jbytes)), C.CString(string(cbytes)), nil
+}
+
+// RegoEvalParsed is like RegoEval, but converts the input to OPA's internal
+// representation before evaluating rather than during evaluation.
+//
+//export RegoEvalParsed
+func RegoEvalParsed(id uint64, inputstr string) (*C.char, *C.char) {
+	ctx := context.Background()
+
+	input, err := parseInputValue(inputstr)
+	if err != nil {
+		return nil, cError(err)
+	}
+
+	results, err := evalInput(ctx, id, input)
+	if err != nil {
+		return nil, cError(err)
+	}
+
+	return resultsCString(results)
+}
+
+// batchResult is an element of the array returned by RegoEvalBatch.
+type batchResult struct {
+	Result rego.ResultSet `json:"result"`
+	Error  *cerror        `json:"error,omitempty"`
+}
+
+// RegoEvalBatch evaluates the query against each input in inputsJSON, a JSON
+// array, and returns a JSON array with the outcome for each input in the same
+// order: {"result": [...]} on success or {"result": null, "error": {...}} if
+// that input failed, where the error has the same form as those returned by
+// the other functions. It only returns an error if the call as a whole fails.
+//
+//export RegoEvalBatch
+func RegoEvalBatch(id uint64, inputsJSON string) (*C.char, *C.char) {
+	ctx := context.Background()
+
+	p, err := defaultEvaluator.lookup(id)
+	if err != nil {
+		return nil, cError(err)
+	}
+
+	var inputs []interface{}
+	err = util.UnmarshalJSON([]byte(inputsJSON), &inputs)
+	if err != nil {
+		return nil, cError(withCode(codeInvalidInput, err))
+	}
+
+	batch := make([]batchResult, len(inputs))
+	for i := range inputs {
+		input, err := ast.InterfaceToValue(inputs[i])
+		if err != nil {
+			err = withCode(codeInvalidInput, err)
+		} else {
+			batch[i].Result, err = p.eval(ctx, id, input)
+		}
+		if err != nil {
+			batch[i].Error = newCError(err)
+		}
+	}
+
+	jbytes, err := json.Marshal(batch)
+	if err != nil {
+		return nil, cError(err)
+	}
+
+	return C.CString(string(jbytes)), nil
+}
+
+// RegoEvalMany evaluates each of the queries ids against the same input,
+// parsing it only once, and returns a JSON object keyed by id with the outcome
+// for each query in the same form as RegoEvalBatch. It only returns an error
+// if the call as a whole fails.
+//
+//export RegoEvalMany
+func RegoEvalMany(ids []uint64, inputstr string) (*C.char, *C.char) {
+	ctx := context.Background()
+
+	input, err := parseInputValue(inputstr)
+	if err != nil {
+		return nil, cError(err)
+	}
+
+	many := make(map[uint64]batchResult, len(ids))
+	for _, id := range ids {
+		var r batchResult
+		r.Result, err = evalInput(ctx, id, input)
+		if err != nil {
+			r.Error = newCError(err)
+		}
+		many[id] = r
+	}
+
+	jbytes, err := json.Marshal(many)
+	if err != nil {
+		return nil, cError(err)
+	}
+
+	return C.CString(string(jbytes)), nil
+}
+
+// The combinators RegoEvalCombine applies to the decisions of its queries.
+const (
+	combineDenyOverrides   = 0
+	combinePermitOverrides = 1
+	combineFirstApplicable = 2
+)
+
+// RegoEvalCombine evaluates each of the queries ids against the same input,
+// parsing it only once, and combines their decisions into one. Each query
+// must be undefined or produce a boolean; true permits and false denies. The
+// combinator is one of:
+//
+//	0 (deny-overrides): false if any query denies, else true if any permits
+//	1 (permit-overrides): true if any query permits, else false
+//	2 (first-applicable): the decision of the first query that is defined
+//
+// If no query is defined, the decision is false. Queries are evaluated in
+// order and evaluation stops once the decision is known, so errors from later
+// queries are not reported. A query that fails or produces a non-boolean value
+// fails the call with an "eval_error".
+//
+//export RegoEvalCombine
+func RegoEvalCombine(ids []uint64, inputstr string, combinator int) (bool, *C.char) {
+	ctx := context.Background()
+
+	if combinator < combineDenyOverrides || combinator > combineFirstApplicable {
+		return false, cError(invalidArgument("unknown combinator %d", combinator))
+	}
+
+	input, err := parseInputValue(inputstr)
+	if err != nil {
+		return false, cError(err)
+	}
+
+	permitted := false
+	for _, id := range ids {
+		results, err := evalInput(ctx, id, input)
+		if err != nil {
+			return false, cError(err)
+		}
+
+		if len(results) == 0 || len(results[0].Expressions) == 0 {
+			continue
+		}
+
+		decision, ok := firstValue(results).(bool)
+		if !ok {
+			return false, cError(withCode(codeEval, fmt.Errorf("query %d did not produce a boolean decision", id)))
+		}
+
+		switch {
+		case combinator == combineFirstApplicable:
+			return decision, nil
+		case combinator == combineDenyOverrides && !decision:
+			return false, nil
+		case combinator == combinePermitOverrides && decision:
+			return true, nil
+		}
+
+		permitted = permitted || decision
+	}
+
+	return permitted, nil
+}
+
+func evalJSON(ctx context.Context, id uint64, inputstr string) ([]byte, error) {
+	results, err := eval(ctx, id, inputstr)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(results)
+}
+
+// resultsCString renders results as JSON in a C string.
+func resultsCString(results rego.ResultSet) (*C.char, *C.char) {
+	jbytes, err := json.Marshal(results)
+	if err != nil {
+		return nil, cError(err)
+	}
+
+	return C.CString(string(jbytes)), nil
+}
+
+func eval(ctx context.Context, id uint64, inputstr string, evalArgs ...rego.EvalOption) (rego.ResultSet, error) {
+	input, err := parseInput(inputstr)
+	if err != nil {
+		return nil, err
+	}
+
+	return evalInput(ctx, id, input, evalArgs...)
+}
+
+// evalInput evaluates query id against input, which is either a value decoded
+// from JSON or an ast.Value.
+func evalInput(ctx context.Context, id uint64, input interface{}, evalArgs ...rego.EvalOption) (rego.ResultSet, error) {
+	p, err := defaultEvaluator.lookup(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.eval(ctx, id, input, evalArgs...)
+}
+
+// noInput is passed as the input to evaluate without any input document, so
+// that input is undefined rather than null.
+type noInput struct{}
+
+func (p *policy) eval(ctx context.Context, id uint64, input interface{}, evalArgs ...rego.EvalOption) (rego.ResultSet, error) {
+	switch value := input.(type) {
+	case noInput:
+	case ast.Value:
+		evalArgs = append(evalArgs, rego.EvalParsedInput(value))
+	default:
+		evalArgs = append(evalArgs, rego.EvalInput(input))
+	}
+
+	if p.options.disableIndexing {
+		evalArgs = append(evalArgs, rego.EvalRuleIndexing(false))
+	}
+
+	start := time.Now()
+	results, err := p.query.Eval(ctx, evalArgs...)
+	if p.logDecisions {
+		logDecision(ctx, id, input, results, err, start)
+	}
+
+	if err != nil {
+		return nil, withCode(codeEval, err)
+	}
+
+	return results, nil
+}
+
+// parseInput decodes the input JSON. Numbers are decoded as json.Number rather
+// than float64, so integers beyond 2^53 keep their precision. The decoder
+// reads the string in place rather than a copy of it as a byte slice.
+func parseInput(inputstr string) (interface{}, error) {
+	decoder := json.NewDecoder(strings.NewReader(inputstr))
+	decoder.UseNumber()
+
+	var input interface{}
+	err := decoder.Decode(&input)
+	if err != nil {
+		return nil, withCode(codeInvalidInput, err)
+	}
+
+	return input, nil
+}
+
+// parseInputValue is like parseInput, but converts the input to an ast.Value
+// up front rather than on every evaluation.
+func parseInputValue(inputstr string) (ast.Value, error) {
+	input, err := parseInput(inputstr)
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := ast.InterfaceToValue(input)
+	if err != nil {
+		return nil, withCode(codeInvalidInput, err)
+	}
+
+	return value, nil
+}
+
+// firstValue returns the value of the first expression of the first result,
+// or nil if the query is undefined.
+func firstValue(results rego.ResultSet) interface{} {
+	if len(results) == 0 || len(results[0].Expressions) == 0 {
+		return nil
+	}
+	return results[0].Expressions[0].Value
+}
+
+func floatValue(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	case float64:
+		return n, true
+	default:
+		return 0, false
+	}
+}
+
+func intValue(v interface{}) (int64, bool) {
+	if n, ok := v.(json.Number); ok {
+		if i, err := n.Int64(); err == nil {
+			return i, true
+		}
+	}
+
+	f, ok := floatValue(v)
+	if !ok || f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+		return 0, false
+	}
+	return int64(f), true
+}
+
+// Evaluators
+
+// evaluators holds the evaluators handed out by RegoNewEvaluator, keyed by
+// handle. Handle 0 always refers to defaultEvaluator.
+var (
+	evaluators            = make(map[uint64]*evaluator)
+	evaluatorMutex        = &sync.RWMutex{}
+	evaluatorIds   uint64 = 0
+)
+
+var errEvaluatorNotFound = withCode(codeNotFound, errors.New("could not find evaluator"))
+
+// RegoNewEvaluator returns a handle to a new evaluator with its own set of
+// queries, ids and lock, isolated from every other evaluator.
+//
+//export RegoNewEvaluator
+func RegoNewEvaluator() uint64 {
+	evaluatorMutex.Lock()
+	defer evaluatorMutex.Unlock()
+
+	for {
+		evaluatorIds += 1
+		if _, found := evaluators[evaluatorIds]; evaluatorIds != 0 && !found {
+			break
+		}
+	}
+	evaluators[evaluatorIds] = newEvaluator()
+
+	return evaluatorIds
+}
+
+// RegoDropEvaluator drops the evaluator and every query in it. Handle 0 cannot
+// be dropped.
+//
+//export RegoDropEvaluator
+func RegoDropEvaluator(handle uint64) {
+	evaluatorMutex.Lock()
+	delete(evaluators, handle)
+	evaluatorMutex.Unlock()
+}
+
+// RegoEvaluatorNew is like RegoNew, but registers the query in the evaluator
+// handle. The returned id is only meaningful to that evaluator.
+//
+//export RegoEvaluatorNew
+func RegoEvaluatorNew(handle uint64, query string, modulename string, modulecontent string) (uint64, *C.char) {
+	ctx := context.Background()
+
+	e, err := lookupEvaluator(handle)
+	if err != nil {
+		return 0, cError(err)
+	}
+
+	p, err := newPolicy(ctx, inmem.New(), newCompiler(),
+		rego.Query(query),
+		rego.Module(clone(modulename), modulecontent),
+	)
+	if err != nil {
+		return 0, cError(err)
+	}
+
+	id, err := e.register(p)
+	if err != nil {
+		return 0, cError(err)
+	}
+
+	return id, nil
+}
+
+// evaluatorKey is the context key of the handle of the evaluator passed to
+// RegoEvaluatorEval, which is logged with its decisions.
+type evaluatorKey struct{}
+
+// RegoEvaluatorEval is like RegoEval for the query id in the evaluator handle.
+//
+//export RegoEvaluatorEval
+func RegoEvaluatorEval(handle uint64, id uint64, inputstr string) (*C.char, *C.char) {
+	ctx := context.WithValue(context.Background(), evaluatorKey{}, handle)
+
+	e, err := lookupEvaluator(handle)
+	if err != nil {
+		return nil, cError(err)
+	}
+
+	p, err := e.lookup(id)
+	if err != nil {
+		return nil, cError(err)
+	}
+
+	input, err := parseInput(inputstr)
+	if err != nil {
+		return nil, cError(err)
+	}
+
+	results, err := p.eval(ctx, id, input)
+	if err != nil {
+		return nil, cError(err)
+	}
+
+	return resultsCString(results)
+}
+
+// RegoEvaluatorDrop is like RegoDrop for the query id in the evaluator handle.
+//
+//export RegoEvaluatorDrop
+func RegoEvaluatorDrop(handle uint64, id uint64) {
+	if e, err := lookupEvaluator(handle); err == nil {
+		e.drop(id)
+	}
+}
+
+func lookupEvaluator(handle uint64) (*evaluator, error) {
+	if handle == 0 {
+		return defaultEvaluator, nil
+	}
+
+	evaluatorMutex.RLock()
+	e, found := evaluators[handle]
+	evaluatorMutex.RUnlock()
+
+	if !found {
+		return nil, errEvaluatorNotFound
+	}
+
+	return e, nil
+}
+
+// Errors
+
+// Error codes. Every error returned as a *C.char is a JSON object with one of
+// these codes and a message. Compile errors also list OPA's errors, each with
+// its own code, message and location, and evaluation errors carry the
+// location they occurred at, if known.
+const (
+	codeNotFound        = "not_found"
+	codeInvalidInput    = "invalid_input"
+	codeInvalidArgument = "invalid_argument"
+	codeCompile         = "compile_error"
+	codeEval            = "eval_error"
+	codeTimeout         = "timeout"
+	codeCanceled        = "canceled"
+	codeTooLarge        = "too_large"
+	codeResourceLimit   = "resource_limit"
+	codeInternal        = "internal_error"
+)
+
+var errNotFound = withCode(codeNotFound, errors.New("could not find rego query"))
+
+type codedError struct {
+	code string
+	err  error
+}
+
+func (e *codedError) Error() string {
+	return e.err.Error()
+}
+
+// withCode attaches code to err, replacing any code it already had.
+func withCode(code string, err error) error {
+	if coded, ok := err.(*codedError); ok {
+		err = coded.err
+	}
+	return &codedError{code, err}
+}
+
+func invalidArgument(format string, a ...interface{}) error {
+	return withCode(codeInvalidArgument, fmt.Errorf(format, a...))
+}
+
+// cerror is the JSON form of an error returned across the FFI.
+type cerror struct {
+	Code     string        `json:"code"`
+	Message  string        `json:"message"`
+	Location *ast.Location `json:"location,omitempty"`
+	Errors   ast.Errors    `json:"errors,omitempty"`
+}
+
+// cError renders err as JSON in a C string. Errors without a code are
+// reported as internal errors.
+func cError(err error) *C.char {
+	e := newCError(err)
+
+	jbytes, merr := json.Marshal(e)
+	if merr != nil {
+		return C.CString(e.Message)
+	}
+
+	return C.CString(string(jbytes))
+}
+
+// newCError converts err to its JSON form.
+func newCError(err error) *cerror {
+	e := &cerror{
+		Code:    codeInternal,
+		Message: err.Error(),
+	}
+
+	if coded, ok := err.(*codedError); ok {
+		e.Code = coded.code
+		err = coded.err
+	}
+
+	if errs, ok := astErrors(err); ok {
+		e.Errors = errs
+	} else if err, ok := err.(*topdown.Error); ok {
+		e.Location = err.Location
+	}
+
+	return e
+}
+
+// astErrors flattens the parse and compile errors in err, which may be wrapped
+// in rego.Errors when several modules fail to parse.
+func astErrors(err error) (ast.Errors, bool) {
+	switch err := err.(type) {
+	case ast.Errors:
+		return err, true
+	case *ast.Error:
+		return ast.Errors{err}, true
+	case rego.Errors:
+		return flattenErrors(err)
+	case loader.Errors:
+		return flattenErrors(err)
+	default:
+		return nil, false
+	}
+}
+
+func flattenErrors(errs []error) (ast.Errors, bool) {
+	var flattened ast.Errors
+	for _, err := range errs {
+		nested, ok := astErrors(err)
+		if !ok {
+			return nil, false
+		}
+		flattened = append(flattened, nested...)
+	}
+	return flattened, len(flattened) > 0
+}
+
+// Checking
+
+// RegoCheck parses and compiles a module without preparing a query. It
+// returns nil if the module is valid, or a "compile_error" listing every
+// problem found.
+//
+//export RegoCheck
+func RegoCheck(modulename string, modulecontent string) *C.char {
+	module, err := ast.ParseModule(modulename, modulecontent)
+	if err != nil {
+		return cError(withCode(codeCompile, err))
+	}
+
+	compiler := newCompiler()
+	compiler.Compile(map[string]*ast.Module{modulename: module})
+	if compiler.Failed() {
+		return cError(withCode(codeCompile, compiler.Errors))
+	}
+
+	return nil
+}
+
+// RegoCheckRelaxed is like RegoCheck, but calls to functions that are neither
+// builtins of the embedded OPA, registered with RegoRegisterBuiltin, nor
+// defined by the module are not errors. Instead, it returns the names of those
+// unknown builtins as a sorted JSON array of warnings. Each is checked as
+// taking as many arguments as its shortest call passes and returning any
+// value.
+//
+//export RegoCheckRelaxed
+func RegoCheckRelaxed(modulename string, modulecontent string) (*C.char, *C.char) {
+	module, err := ast.ParseModule(clone(modulename), modulecontent)
+	if err != nil {
+		return nil, cError(withCode(codeCompile, err))
+	}
+
+	unknown := unknownBuiltins(module)
+
+	compiler := prepareOptions{relaxed: unknown}.compiler()
+	compiler.Compile(map[string]*ast.Module{modulename: module})
+	if compiler.Failed() {
+		return nil, cError(withCode(codeCompile, compiler.Errors))
+	}
+
+	jbytes, err := json.Marshal(sortedBuiltinNames(unknown))
+	if err != nil {
+		return nil, cError(err)
+	}
+
+	return C.CString(string(jbytes)), nil
+}
+
+// RegoNewRelaxed is like RegoNew, but treats calls to unknown builtins in the
+// module in the same way as RegoCheckRelaxed, and returns their names as
+// warnings along with the id. When evaluated, a call to an unknown builtin is
+// undefined.
+//
+//export RegoNewRelaxed
+func RegoNewRelaxed(query string, modulename string, modulecontent string) (uint64, *C.char, *C.char) {
+	ctx := context.Background()
+
+	module, err := ast.ParseModule(clone(modulename), modulecontent)
+	if err != nil {
+		return 0, nil, cError(withCode(codeCompile, err))
+	}
+
+	unknown := unknownBuiltins(module)
+
+	options := prepareOptions{relaxed: unknown}
+
+	id, err := prepareWithOptions(ctx, inmem.New(), options,
+		rego.Query(query),
+		rego.ParsedModule(module),
+	)
+	if err != nil {
+		return 0, nil, cError(err)
+	}
+
+	jbytes, err := json.Marshal(sortedBuiltinNames(unknown))
+	if err != nil {
+		RegoDrop(id)
+		return 0, nil, cError(err)
+	}
+
+	return id, C.CString(string(jbytes)), nil
+}
+
+// unknownBuiltins returns the functions called by module that are neither
+// builtins, registered with RegoRegisterBuiltin, nor defined by the module or
+// under data, along with the number of arguments passed by the shortest call
+// to each.
+func unknownBuiltins(module *ast.Module) map[string]int {
+	defined := map[string]bool{}
+	for _, rule := range module.Rules {
+		if len(rule.Head.Args) > 0 {
+			defined[string(rule.Head.Name)] = true
+		}
+	}
+
+	imported := map[string]bool{}
+	for _, imp := range module.Imports {
+		imported[string(imp.Name())] = true
+	}
+
+	builtinMutex.RLock()
+	defer builtinMutex.RUnlock()
+
+	unknown := map[string]int{}
+	record := func(operator ast.Ref, arity int) {
+		if len(operator) == 0 || operator[0].Equal(ast.DefaultRootDocument) || imported[operator[0].Value.String()] {
+			return
+		}
+
+		name := operator.String()
+		if _, found := ast.BuiltinMap[name]; found {
+			return
+		}
+		if _, found := builtins[name]; found || defined[name] {
+			return
+		}
+
+		if current, found := unknown[name]; !found || arity < current {
+			unknown[name] = arity
+		}
+	}
+
+	ast.WalkExprs(module, func(expr *ast.Expr) bool {
+		if expr.IsCall() {
+			record(expr.Operator(), len(expr.Operands()))
+		}
+		return false
+	})
+
+	ast.WalkTerms(module, func(term *ast.Term) bool {
+		if call, ok := term.Value.(ast.Call); ok {
+			if operator, ok := call[0].Value.(ast.Ref); ok {
+				record(operator, len(call)-1)
+			}
+		}
+		return false
+	})
+
+	return unknown
+}
+
+func unknownDecls(unknown map[string]int) map[string]*rego.Function {
+	decls := make(map[string]*rego.Function, len(unknown))
+	for name, arity := range unknown {
+		args := make([]types.Type, arity)
+		for i := range args {
+			args[i] = types.A
+		}
+
+		decls[name] = &rego.Function{
+			Name: name,
+			Decl: types.NewFunction(args, types.A),
+		}
+	}
+	return decls
+}
+
+func sortedBuiltinNames(unknown map[string]int) []string {
+	names := make([]string, 0, len(unknown))
+	for name := range unknown {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// undefinedBuiltin implements unknown builtins for RegoNewRelaxed.
+func undefinedBuiltin(bctx rego.BuiltinContext, terms []*ast.Term) (*ast.Term, error) {
+	return nil, nil
+}
+
+// RegoCheckPath is like RegoCheck, but parses and compiles every module under
+// paths, skipping any file or directory whose name matches one of the ignore
+// patterns. Parse errors are reported for every file at once; the modules are
+// only compiled if they all parse.
+//
+//export RegoCheckPath
+func RegoCheckPath(paths []string, ignore []string) *C.char {
+	f := loaderFilter{
+		Ignore: ignore,
+	}
+
+	result, err := loader.Filtered(paths, f.Apply)
+	if err != nil {
+		return cError(withCode(codeCompile, err))
+	}
+
+	modules := make(map[string]*ast.Module, len(result.Modules))
+	for name, file := range result.Modules {
+		modules[name] = file.Parsed
+	}
+
+	compiler := newCompiler()
+	compiler.Compile(modules)
+	if compiler.Failed() {
+		return cError(withCode(codeCompile, compiler.Errors))
+	}
+
+	return nil
+}
+
+// compiledQuery is the result of RegoCompileQuery.
+type compiledQuery struct {
+	Query string `json:"query"`
+}
+
+// RegoCompileQuery parses and compiles a query on its own, without any
+// modules, and checks that it is safe. Builtins registered with
+// RegoRegisterBuiltin are allowed. It returns the query as rewritten by the
+// compiler, as a JSON object {"query": "..."}, or a "compile_error" listing
+// every problem found, such as unsafe variables or unknown functions.
+//
+//export RegoCompileQuery
+func RegoCompileQuery(query string) (*C.char, *C.char) {
+	body, err := ast.ParseBody(query)
+	if err != nil {
+		return nil, cError(withCode(codeCompile, err))
+	}
+
+	compiled, err := newCompiler().QueryCompiler().Compile(body)
+	if err != nil {
+		return nil, cError(withCode(codeCompile, err))
+	}
+
+	jbytes, err := json.Marshal(compiledQuery{Query: compiled.String()})
+	if err != nil {
+		return nil, cError(err)
+	}
+
+	return C.CString(string(jbytes)), nil
+}
+
+// RegoParseModule parses a module without compiling it and returns its AST
+// as JSON, or a "compile_error" listing the parse errors.
+//
+//export RegoParseModule
+func RegoParseModule(modulename string, modulecontent string) (*C.char, *C.char) {
+	module, err := ast.ParseModule(modulename, modulecontent)
+	if err != nil {
+		return nil, cError(withCode(codeCompile, err))
+	}
+
+	jbytes, err := json.Marshal(module)
+	if err != nil {
+		return nil, cError(err)
+	}
+
+	return C.CString(string(jbytes)), nil
+}
+
+// ruleInfo describes a rule defined by a module.
+type ruleInfo struct {
+	Path string `json:"path"`
+	Kind string `json:"kind"`
+}
+
+// RegoRules parses a module without compiling it and returns the rules it
+// defines as a JSON array of {"path": "data.example.allow", "kind": "..."},
+// in the order they are first defined. The kind is one of "complete",
+// "partial_set", "partial_object" or "function". A rule defined by several
+// definitions is listed once. It returns a "compile_error" listing the parse
+// errors if the module does not parse.
+//
+//export RegoRules
+func RegoRules(modulename string, modulecontent string) (*C.char, *C.char) {
+	module, err := ast.ParseModule(modulename, modulecontent)
+	if err != nil {
+		return nil, cError(withCode(codeCompile, err))
+	}
+
+	rules := []ruleInfo{}
+	seen := map[string]bool{}
+	for _, rule := range module.Rules {
+		path := module.Package.Path.Append(ast.StringTerm(string(rule.Head.Name))).String()
+		if seen[path] {
+			continue
+		}
+		seen[path] = true
+
+		rules = append(rules, ruleInfo{Path: path, Kind: ruleKind(rule.Head)})
+	}
+
+	jbytes, err := json.Marshal(rules)
+	if err != nil {
+		return nil, cError(err)
+	}
+
+	return C.CString(string(jbytes)), nil
+}
+
+func ruleKind(head *ast.Head) string {
+	switch {
+	case len(head.Args) > 0:
+		return "function"
+	case head.Key != nil && head.Value != nil:
+		return "partial_object"
+	case head.Key != nil:
+		return "partial_set"
+	default:
+		return "complete"
+	}
+}
+
+// RegoFormat returns the module formatted in the same way as opa fmt, or a
+// "compile_error" if it does not parse.
+//
+//export RegoFormat
+func RegoFormat(modulename string, modulecontent string) (*C.char, *C.char) {
+	formatted, err := format.Source(modulename, []byte(modulecontent))
+	if err != nil {
+		return nil, cError(withCode(codeCompile, err))
+	}
+
+	return C.CString(string(formatted)), nil
+}
+
+// One-shot queries
+
+// RegoQueryData evaluates query once, without any modules, against the base
+// data document dataJSON, which must be a JSON object or empty, and the input
+// inputstr. It returns the result set in the same form as RegoEval. Nothing is
+// registered and the evaluation is not decision logged.
+//
+//export RegoQueryData
+func RegoQueryData(query string, dataJSON string, inputstr string) (*C.char, *C.char) {
+	ctx := context.Background()
+
+	data := map[string]interface{}{}
+	if strings.TrimSpace(dataJSON) != "" {
+		err := util.UnmarshalJSON([]byte(dataJSON), &data)
+		if err != nil {
+			return nil, cError(withCode(codeInvalidInput, err))
+		}
+	}
+
+	input, err := parseInput(inputstr)
+	if err != nil {
+		return nil, cError(err)
+	}
+
+	p, err := newPolicy(ctx, inmem.NewFromObject(data), newCompiler(), rego.Query(query))
+	if err != nil {
+		return nil, cError(err)
+	}
+	p.logDecisions = false
+
+	results, err := p.eval(ctx, 0, input)
+	if err != nil {
+		return nil, cError(err)
+	}
+
+	return resultsCString(results)
+}
+
+// Partial evaluation
+
+// RegoPartial partially evaluates query against a single module, treating the
+// references in unknowns (e.g. "input.user") as unknown. It returns the
+// residual queries and their support modules as JSON, in the same format as
+// OPA's compile API.
+//
+//export RegoPartial
+func RegoPartial(query string, modulename string, modulecontent string, unknowns []string, inputstr string) (*C.char, *C.char) {
+	ctx := context.Background()
+
+	input, err := parseInput(inputstr)
+	if err != nil {
+		return nil, cError(err)
+	}
+
+	regoArgs := []func(*rego.Rego){
+		rego.Query(query),
+		rego.Module(modulename, modulecontent),
+		rego.Unknowns(unknowns),
+		rego.Input(input),
+	}
+	regoArgs = append(regoArgs, builtinArgs()...)
+
+	pq, err := rego.New(regoArgs...).Partial(ctx)
+	if err != nil {
+		if _, ok := astErrors(err); ok {
+			return nil, cError(withCode(codeCompile, err))
+		}
+		return nil, cError(withCode(codeEval, err))
+	}
+
+	jbytes, err := json.Marshal(pq)
+	if err != nil {
+		return nil, cError(err)
+	}
+
+	return C.CString(string(jbytes)), nil
+}
+
+// Builtins
+
+type builtin struct {
+	arity int
+	token uint64
+}
+
+// builtins holds the functions added with RegoRegisterBuiltin, keyed by name.
+var (
+	builtins        = make(map[string]builtin)
+	builtinCallback C.builtin_callback
+	builtinMutex    = &sync.RWMutex{}
+)
+
+// RegoSetBuiltinCallback installs the function that implements the builtins
+// added with RegoRegisterBuiltin. It is passed the builtin's token and its
+// arguments as a JSON array, and returns the result as JSON, or NULL if the
+// result is undefined. To fail the evaluation, it sets *err to an error
+// message instead. The result and error must be allocated with malloc and are
+// freed by the caller; args is only valid for the duration of the call.
+//
+// The callback may be called from several threads at once.
+//
+//export RegoSetBuiltinCallback
+func RegoSetBuiltinCallback(cb C.builtin_callback) {
+	builtinMutex.Lock()
+	builtinCallback = cb
+	builtinMutex.Unlock()
+}
+
+// RegoRegisterBuiltin adds a builtin function called name taking arity
+// arguments. Calls to it are passed to the callback along with callbackToken.
+// Only queries prepared after the builtin is registered can call it.
+//
+//export RegoRegisterBuiltin
+func RegoRegisterBuiltin(name string, arity int, callbackToken uint64) *C.char {
+	if arity < 0 {
+		return cError(invalidArgument("invalid arity %d for builtin %s", arity, name))
+	}
+
+	if _, found := ast.BuiltinMap[name]; found {
+		return cError(invalidArgument("builtin %s already exists", name))
+	}
+
+	builtinMutex.Lock()
+	builtins[clone(name)] = builtin{arity, callbackToken}
+	builtinMutex.Unlock()
+
+	return nil
+}
+
+func builtinArgs() []func(*rego.Rego) {
+	builtinMutex.RLock()
+	defer builtinMutex.RUnlock()
+
+	var regoArgs []func(*rego.Rego)
+	for name, b := range builtins {
+		args := make([]types.Type, b.arity)
+		for i := range args {
+			args[i] = types.A
+		}
+
+		decl := &rego.Function{
+			Name: name,
+			Decl: types.NewFunction(args, types.A),
+		}
+		regoArgs = append(regoArgs, rego.FunctionDyn(decl, callBuiltin(name, b.token)))
+	}
+
+	return regoArgs
+}
+
+// builtinDecls returns the declarations of the registered builtins, for
+// compilers that are not created through rego. See newCompiler.
+func builtinDecls() map[string]*ast.Builtin {
+	builtinMutex.RLock()
+	defer builtinMutex.RUnlock()
+
+	decls := make(map[string]*ast.Builtin, len(builtins))
+	for name, b := range builtins {
+		args := make([]types.Type, b.arity)
+		for i := range args {
+			args[i] = types.A
+		}
+
+		decls[name] = &ast.Builtin{
+			Name: name,
+			Decl: types.NewFunction(args, types.A),
+		}
+	}
+
+	return decls
+}
+
+func callBuiltin(name string, token uint64) rego.BuiltinDyn {
+	return func(bctx rego.BuiltinContext, terms []*ast.Term) (*ast.Term, error) {
+		builtinMutex.RLock()
+		cb := builtinCallback
+		builtinMutex.RUnlock()
+
+		if cb == nil {
+			return nil, fmt.Errorf("%s: no builtin callback installed", name)
+		}
+
+		args := make([]interface{}, len(terms))
+		for i, term := range terms {
+			arg, err := ast.JSON(term.Value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", name, err)
+			}
+			args[i] = arg
+		}
+
+		abytes, err := json.Marshal(args)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+
+		cargs := C.CString(string(abytes))
+		defer C.free(unsafe.Pointer(cargs))
+
+		var cerr *C.char
+		cresult := C.call_builtin(cb, C.ulonglong(token), cargs, &cerr)
+		if cerr != nil {
+			defer C.free(unsafe.Pointer(cerr))
+			return nil, fmt.Errorf("%s: %s", name, C.GoString(cerr))
+		}
+
+		if cresult == nil {
+			return nil, nil
+		}
+		defer C.free(unsafe.Pointer(cresult))
+
+		var result interface{}
+		err = util.UnmarshalJSON([]byte(C.GoString(cresult)), &result)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+
+		value, err := ast.InterfaceToValue(result)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+
+		return ast.NewTerm(value), nil
+	}
+}
+
+// Decision logs
+
+// decision is the record passed to the decision log callback. Input is
+// omitted for evaluations made without any input.
+type decision struct {
+	ID         uint64         `json:"id"`
+	Evaluator  uint64         `json:"evaluator"`
+	Timestamp  string         `json:"timestamp"`
+	Input      *interface{}   `json:"input,omitempty"`
+	Result     rego.ResultSet `json:"result"`
+	Error      string         `json:"error,omitempty"`
+	DurationNs int64          `json:"durationNs"`
+	TraceID    string         `json:"traceId,omitempty"`
+}
+
+var (
+	decisionLogCallback C.decision_log_callback
+	decisionLogToken    uint64
+	decisionLogMutex    = &sync.RWMutex{}
+)
+
+// RegoSetDecisionLogCallback installs a function that is called after every
+// evaluation with token and the decision as a JSON object with the query id,
+// the handle of its evaluator (0 for queries created by RegoNew), the time
+// the evaluation started in RFC 3339 format and UTC, input, result, error (if
+// any), duration in nanoseconds and, for RegoEvalTraced, trace id. The
+// decision is only valid for the duration of the call. Passing NULL removes
+// the callback.
+//
+// The callback may be called from several threads at once.
+//
+//export RegoSetDecisionLogCallback
+func RegoSetDecisionLogCallback(cb C.decision_log_callback, token uint64) {
+	decisionLogMutex.Lock()
+	decisionLogCallback = cb
+	decisionLogToken = token
+	decisionLogMutex.Unlock()
+}
+
+// RegoSetDecisionLogging opts the query in to or out of decision logging.
+// Queries are logged by default.
+//
+//export RegoSetDecisionLogging
+func RegoSetDecisionLogging(id uint64, enabled bool) *C.char {
+	err := defaultEvaluator.update(id, func(p *policy) *policy {
+		updated := *p
+		updated.logDecisions = enabled
+		return &updated
+	})
+	if err != nil {
+		return cError(err)
+	}
+
+	return nil
+}
+
+func logDecision(ctx context.Context, id uint64, input interface{}, results rego.ResultSet, err error, start time.Time) {
+	decisionLogMutex.RLock()
+	cb := decisionLogCallback
+	token := decisionLogToken
+	decisionLogMutex.RUnlock()
+
+	if cb == nil {
+		return
+	}
+
+	if value, ok := input.(ast.Value); ok {
+		input, _ = ast.JSON(value)
+	}
+
+	d := decision{
+		ID:         id,
+		Timestamp:  start.UTC().Format(time.RFC3339Nano),
+		Result:     results,
+		DurationNs: time.Since(start).Nanoseconds(),
+	}
+	if _, ok := input.(noInput); !ok {
+		d.Input = &input
+	}
+	if err != nil {
+		d.Error = err.Error()
+	}
+	if handle, ok := ctx.Value(evaluatorKey{}).(uint64); ok {
+		d.Evaluator = handle
+	}
+	if traceID, ok := ctx.Value(traceIDKey{}).(string); ok {
+		d.TraceID = traceID
+	}
+
+	dbytes, merr := json.Marshal(d)
+	if merr != nil {
+		return
+	}
+
+	cdecision := C.CString(string(dbytes))
+	defer C.free(unsafe.Pointer(cdecision))
+
+	C.call_decision_log(cb, C.ulonglong(token), cdecision)
+}
+
+// Data
+
+// RegoSetData writes the JSON value at the slash-separated path (e.g.
+// "/config/users") of the query's data, creating any missing parents.
+//
+// Each evaluation reads its data in its own transaction, so it sees the data
+// either entirely before or entirely after a write, never part of one.
+// Modules are compiled by RegoNew and are not affected.
+//
+//export RegoSetData
+func RegoSetData(id uint64, path string, valueJSON string) *C.char {
+	ctx := context.Background()
+
+	p, err := defaultEvaluator.lookup(id)
+	if err != nil {
+		return cError(err)
+	}
+
+	// The store keeps the segments of the path as keys, so they must not
+	// point into the caller's memory.
+	storagePath, ok := storage.ParsePath(clone(path))
+	if !ok {
+		return cError(invalidArgument("invalid data path %q", path))
+	}
+
+	var value interface{}
+	err = util.UnmarshalJSON([]byte(valueJSON), &value)
+	if err != nil {
+		return cError(withCode(codeInvalidInput, err))
+	}
+
+	err = writeData(ctx, p.store, storage.AddOp, storagePath, value)
+	if err != nil {
+		return cError(err)
+	}
+
+	return nil
+}
+
+// RegoRemoveData removes the document at the slash-separated path of the
+// query's data. See RegoSetData for the consistency guarantee.
+//
+//export RegoRemoveData
+func RegoRemoveData(id uint64, path string) *C.char {
+	ctx := context.Background()
+
+	p, err := defaultEvaluator.lookup(id)
+	if err != nil {
+		return cError(err)
+	}
+
+	storagePath, ok := storage.ParsePath(clone(path))
+	if !ok {
+		return cError(invalidArgument("invalid data path %q", path))
+	}
+
+	err = writeData(ctx, p.store, storage.RemoveOp, storagePath, nil)
+	if err != nil {
+		return cError(err)
+	}
+
+	return nil
+}
+
+// dataPatch is a single operation of a JSON Patch.
+type dataPatch struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value"`
+}
+
+// RegoPatchData applies the JSON Patch (RFC 6902) patchJSON to the query's
+// data, in the same way as a PATCH to OPA's data API: the operations "add",
+// "remove" and "replace" are supported, each path is a JSON pointer (e.g.
+// "/revoked/abc"), and unlike RegoSetData, missing parents are not created.
+// The operations are applied in one transaction, so either all of them are
+// applied or, if any fails, none are. See RegoSetData for the consistency
+// guarantee.
+//
+//export RegoPatchData
+func RegoPatchData(id uint64, patchJSON string) *C.char {
+	ctx := context.Background()
+
+	p, err := defaultEvaluator.lookup(id)
+	if err != nil {
+		return cError(err)
+	}
+
+	var patches []dataPatch
+	err = util.UnmarshalJSON([]byte(patchJSON), &patches)
+	if err != nil {
+		return cError(withCode(codeInvalidInput, err))
+	}
+
+	ops := make([]storage.PatchOp, len(patches))
+	paths := make([]storage.Path, len(patches))
+	for i, patch := range patches {
+		switch patch.Op {
+		case "add":
+			ops[i] = storage.AddOp
+		case "remove":
+			ops[i] = storage.RemoveOp
+		case "replace":
+			ops[i] = storage.ReplaceOp
+		default:
+			return cError(invalidArgument("unsupported patch operation %q", patch.Op))
+		}
+
+		path, ok := storage.ParsePathEscaped(patch.Path)
+		if !ok {
+			return cError(invalidArgument("invalid data path %q", patch.Path))
+		}
+		paths[i] = path
+	}
+
+	txn, err := p.store.NewTransaction(ctx, storage.WriteParams)
+	if err != nil {
+		return cError(err)
+	}
+
+	for i, patch := range patches {
+		err = p.store.Write(ctx, txn, ops[i], paths[i], patch.Value)
+		if err != nil {
+			p.store.Abort(ctx, txn)
+			return cError(storageError(err))
+		}
+	}
+
+	err = p.store.Commit(ctx, txn)
+	if err != nil {
+		return cError(err)
+	}
+
+	return nil
+}
+
+func writeData(ctx context.Context, store storage.Store, op storage.PatchOp, path storage.Path, value interface{}) error {
+	txn, err := store.NewTransaction(ctx, storage.WriteParams)
+	if err != nil {
+		return err
+	}
+
+	if op != storage.RemoveOp && len(path) > 1 {
+		err = storage.MakeDir(ctx, store, txn, path[:len(path)-1])
+		if err != nil {
+			store.Abort(ctx, txn)
+			return storageError(err)
+		}
+	}
+
+	err = store.Write(ctx, txn, op, path, value)
+	if err != nil {
+		store.Abort(ctx, txn)
+		return storageError(err)
+	}
+
+	return store.Commit(ctx, txn)
+}
+
+// storageError codes an error writing to the store: a missing document is
+// not_found, and a write that conflicts with the data, such as one through a
+// non-object parent, is invalid_argument.
+func storageError(err error) error {
+	switch {
+	case storage.IsNotFound(err):
+		return withCode(codeNotFound, err)
+	case storage.IsWriteConflictError(err), storage.IsInvalidPatch(err):
+		return withCode(codeInvalidArgument, err)
+	default:
+		return err
+	}
+}
+
+// Transactions
+
+// openTxn is a read transaction handed out by RegoBeginTxn.
+type openTxn struct {
+	store storage.Store
+	txn   storage.Transaction
+
+	// evals counts the evaluations reading through txn, so that the
+	// transaction is not ended while they run.
+	evals sync.WaitGroup
+}
+
+// txns holds the transactions handed out by RegoBeginTxn, keyed by token.
+var (
+	txns            = make(map[uint64]*openTxn)
+	txnMutex        = &sync.Mutex{}
+	txnIds   uint64 = 0
+)
+
+var errTxnNotFound = withCode(codeNotFound, errors.New("could not find transaction"))
+
+// RegoBeginTxn opens a read transaction on the query's data and returns a
+// token for it. Every RegoEvalInTxn using the token sees the same snapshot of
+// the data. Writes to the data with RegoSetData or RegoRemoveData wait until
+// the transaction is ended with RegoCommitTxn or RegoAbortTxn, so a caller
+// must not write from the same thread while it holds a transaction open.
+//
+// Once a write from another thread is waiting, new reads of the data wait
+// behind it. A thread holding a transaction open must therefore evaluate
+// queries on the same data only with RegoEvalInTxn: a RegoEval or
+// RegoEvalBool from that thread deadlocks until the transaction ends, which
+// it never does.
+//
+//export RegoBeginTxn
+func RegoBeginTxn(id uint64) (uint64, *C.char) {
+	ctx := context.Background()
+
+	p, err := defaultEvaluator.lookup(id)
+	if err != nil {
+		return 0, cError(err)
+	}
+
+	txn, err := p.store.NewTransaction(ctx)
+	if err != nil {
+		return 0, cError(err)
+	}
+
+	txnMutex.Lock()
+	txnIds += 1
+	var token = txnIds
+	txns[token] = &openTxn{store: p.store, txn: txn}
+	txnMutex.Unlock()
+
+	return token, nil
+}
+
+// RegoEvalInTxn is like RegoEval, but reads data through the transaction
+// opened by RegoBeginTxn. The transaction must have been opened on the data
+// of the query with the given id. Ending the transaction waits until the
+// evaluation returns.
+//
+//export RegoEvalInTxn
+func RegoEvalInTxn(id uint64, inputstr string, txnToken uint64) (*C.char, *C.char) {
+	ctx := context.Background()
+
+	txnMutex.Lock()
+	t, found := txns[txnToken]
+	if found {
+		t.evals.Add(1)
+	}
+	txnMutex.Unlock()
+
+	if !found {
+		return nil, cError(errTxnNotFound)
+	}
+	defer t.evals.Done()
+
+	p, err := defaultEvaluator.lookup(id)
+	if err != nil {
+		return nil, cError(err)
+	}
+
+	if p.store != t.store {
+		return nil, cError(invalidArgument("transaction %d was not opened on the data of query %d", txnToken, id))
+	}
+
+	input, err := parseInput(inputstr)
+	if err != nil {
+		return nil, cError(err)
+	}
+
+	results, err := p.eval(ctx, id, input, rego.EvalTransaction(t.txn))
+	if err != nil {
+		return nil, cError(err)
+	}
+
+	return resultsCString(results)
+}
+
+// RegoCommitTxn ends the transaction opened by RegoBeginTxn, once the
+// evaluations in it have returned.
+//
+//export RegoCommitTxn
+func RegoCommitTxn(txnToken uint64) *C.char {
+	t, err := takeTxn(txnToken)
+	if err != nil {
+		return cError(err)
+	}
+
+	err = t.store.Commit(context.Background(), t.txn)
+	if err != nil {
+		return cError(err)
+	}
+
+	return nil
+}
+
+// RegoAbortTxn ends the transaction opened by RegoBeginTxn. As the
+// transaction only reads, this is equivalent to RegoCommitTxn.
+//
+//export RegoAbortTxn
+func RegoAbortTxn(txnToken uint64) *C.char {
+	t, err := takeTxn(txnToken)
+	if err != nil {
+		return cError(err)
+	}
+
+	t.store.Abort(context.Background(), t.txn)
+
+	return nil
+}
+
+// takeTxn removes the transaction from txns and waits for the evaluations
+// reading through it to return.
+func takeTxn(txnToken uint64) (*openTxn, error) {
+	txnMutex.Lock()
+	t, found := txns[txnToken]
+	if !found {
+		txnMutex.Unlock()
+		return nil, errTxnNotFound
+	}
+	delete(txns, txnToken)
+	txnMutex.Unlock()
+
+	t.evals.Wait()
+
+	return t, nil
+}
+
+// Capabilities
+
+// capabilities is the subset of OPA's capabilities document that the embedded
+// OPA can describe: the builtins available to policies. Newer versions of OPA
+// describe each builtin's declaration as a JSON type; here it is the
+// declaration's string form, e.g. "(string, string) => boolean".
+type capabilities struct {
+	Builtins []capabilityBuiltin `json:"builtins"`
+}
+
+type capabilityBuiltin struct {
+	Name  string `json:"name"`
+	Infix string `json:"infix,omitempty"`
+	Decl  string `json:"decl"`
+}
+
+// unsafeBuiltins returns the names of the builtins known to the embedded OPA
+// that are missing from caps. The embedded OPA has no notion of a
+// capabilities document, so these are rejected as unsafe builtins instead.
+func (caps capabilities) unsafeBuiltins() map[string]struct{} {
+	allowed := make(map[string]struct{}, len(caps.Builtins))
+	for _, b := range caps.Builtins {
+		allowed[b.Name] = struct{}{}
+	}
+
+	disallowed := make(map[string]struct{})
+	for _, b := range ast.Builtins {
+		if _, ok := allowed[b.Name]; !ok {
+			disallowed[b.Name] = struct{}{}
+		}
+	}
+
+	return disallowed
+}
+
+// RegoCapabilities returns the builtins available to policies as a JSON
+// capabilities document.
+//
+//export RegoCapabilities
+func RegoCapabilities() (*C.char, *C.char) {
+	caps := capabilities{
+		Builtins: make([]capabilityBuiltin, 0, len(ast.Builtins)),
+	}
+
+	for _, b := range ast.Builtins {
+		caps.Builtins = append(caps.Builtins, capabilityBuiltin{
+			Name:  b.Name,
+			Infix: b.Infix,
+			Decl:  b.Decl.String(),
+		})
+	}
+
+	jbytes, err := json.Marshal(caps)
+	if err != nil {
+		return nil, cError(err)
+	}
+
+	return C.CString(string(jbytes)), nil
+}
+
+// Version
+
+// OpaVersion returns the version of the embedded OPA, e.g. "0.18.0".
+//
+//export OpaVersion
+func OpaVersion() *C.char {
+	return C.CString(version.Version)
+}
+
+// OpaVersionInfo returns the version of the embedded OPA, the commit ("vcs")
+// and time ("timestamp") it was built from, and the Go version this library
+// was built with as a JSON object. The commit and time are empty unless they
+// were set when building.
+//
+//export OpaVersionInfo
+func OpaVersionInfo() *C.char {
+	info := map[string]string{
+		"version":    version.Version,
+		"vcs":        version.Vcs,
+		"timestamp":  version.Timestamp,
+		"go_version": runtime.Version(),
+	}
+
+	jbytes, err := json.Marshal(info)
+	if err != nil {
+		return nil
+	}
+
+	return C.CString(string(jbytes))
+}
+
+// Health
+
+// RegoSelfTest parses, compiles and evaluates a trivial policy without
+// touching any registered query. It returns nil if the embedded OPA works end
+// to end, or an "internal_error" naming the stage that failed.
+//
+//export RegoSelfTest
+func RegoSelfTest() *C.char {
+	ctx := context.Background()
+
+	module, err := ast.ParseModule("selftest.rego", "package test\n\nok = true")
+	if err != nil {
+		return cError(withCode(codeInternal, fmt.Errorf("self test failed to parse: %v", err)))
+	}
+
+	compiler := ast.NewCompiler()
+	compiler.Compile(map[string]*ast.Module{"selftest.rego": module})
+	if compiler.Failed() {
+		return cError(withCode(codeInternal, fmt.Errorf("self test failed to compile: %v", compiler.Errors)))
+	}
+
+	prepared, err := rego.New(
+		rego.Query("data.test.ok"),
+		rego.Compiler(compiler),
+		rego.Store(inmem.New()),
+	).PrepareForEval(ctx)
+	if err != nil {
+		return cError(withCode(codeInternal, fmt.Errorf("self test failed to prepare: %v", err)))
+	}
+
+	results, err := prepared.Eval(ctx)
+	if err != nil {
+		return cError(withCode(codeInternal, fmt.Errorf("self test failed to evaluate: %v", err)))
+	}
+
+	if ok, _ := firstValue(results).(bool); !ok {
+		return cError(withCode(codeInternal, fmt.Errorf("self test evaluated to %v, expected true", firstValue(results))))
+	}
+
+	return nil
+}
+
+// Wasm
+
+// loaderFilter skips files and directories matching any of the Ignore
+// patterns, which follow .gitignore conventions like opa build --ignore:
+//
+//   - a pattern without a slash, such as "*_test.rego", matches a name at any
+//     depth
+//   - a pattern containing a slash, such as "tests/**" or "/vendor", matches
+//     a path relative to the directory being loaded
+//   - "**" matches any number of directories
+//   - a trailing slash, as in "vendor/", only matches directories
+//
+// Everything under a matching directory is skipped as well. The paths being
+// loaded are never skipped themselves.
+type loaderFilter struct {
+	Ignore []string
+}
+
+func (f loaderFilter) Apply(abspath string, info os.FileInfo, depth int) bool {
+	if depth < 1 {
+		return false
+	}
+
+	parts := strings.Split(filepath.ToSlash(abspath), "/")
+	if depth > len(parts) {
+		depth = len(parts)
+	}
+	rel := parts[len(parts)-depth:]
+
+	for _, s := range f.Ignore {
+		if ignored(s, rel, info.IsDir()) {
+			return true
+		}
+	}
+	return false
+}
+
+// ignored reports whether pattern matches the path rel, or any directory
+// containing it.
+func ignored(pattern string, rel []string, isDir bool) bool {
+	dirOnly := strings.HasSuffix(pattern, "/")
+	anchored := strings.Contains(strings.TrimSuffix(pattern, "/"), "/")
+
+	segments := strings.Split(strings.Trim(pattern, "/"), "/")
+	if !anchored {
+		segments = append([]string{"**"}, segments...)
+	}
+
+	for n := 1; n <= len(rel); n++ {
+		if dirOnly && n == len(rel) && !isDir {
+			continue
+		}
+		if matchSegments(segments, rel[:n]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchSegments(pattern, path []string) bool {
+	if len(pattern) == 0 {
+		return len(path) == 0
+	}
+
+	if pattern[0] == "**" {
+		for i := 0; i <= len(path); i++ {
+			if matchSegments(pattern[1:], path[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(path) == 0 {
+		return false
+	}
+
+	ok, err := filepath.Match(pattern[0], path[0])
+	return err == nil && ok && matchSegments(pattern[1:], path[1:])
+}
+
+//export WasmBuild
+func WasmBuild(query string, data, bundles, ignore []string) (unsafe.Pointer, int, *C.char) {
+	ctx := context.Background()
+
+	bytes, err := compileWasm(ctx, 0, wasmArgs(query, data, bundles, ignore)...)
+	if err != nil {
+		return nil, 0, cError(err)
+	}
+
+	return C.CBytes(bytes), len(bytes), nil
+}
+
+// loadReport lists the files a build loaded and the files and directories its
+// ignore patterns skipped.
+type loadReport struct {
+	Loaded  []string `json:"loaded"`
+	Ignored []string `json:"ignored"`
+}
+
+// loadRecorder wraps a loader filter, recording every path it lets through or
+// skips.
+type loadRecorder struct {
+	filter  loader.Filter
+	loaded  map[string]struct{}
+	ignored map[string]struct{}
+}
+
+// loadedExtensions are the file types the loader reads; it skips the rest.
+var loadedExtensions = map[string]bool{
+	".rego": true,
+	".json": true,
+	".yaml": true,
+	".yml":  true,
+}
+
+func (r *loadRecorder) Apply(abspath string, info os.FileInfo, depth int) bool {
+	if r.filter(abspath, info, depth) {
+		r.ignored[abspath] = struct{}{}
+		return true
+	}
+
+	if !info.IsDir() && loadedExtensions[filepath.Ext(abspath)] {
+		r.loaded[abspath] = struct{}{}
+	}
+
+	return false
+}
+
+func (r *loadRecorder) report() loadReport {
+	return loadReport{
+		Loaded:  sortedKeys(r.loaded),
+		Ignored: sortedKeys(r.ignored),
+	}
+}
+
+func sortedKeys(m map[string]struct{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// WasmBuildWithReport is like WasmBuild, but also returns a JSON object
+// listing the data files and modules that were loaded from data and the paths
+// the ignore patterns skipped: {"loaded": [...], "ignored": [...]}. Bundles
+// are loaded whole and are listed under "loaded" as given.
+//
+//export WasmBuildWithReport
+func WasmBuildWithReport(query string, data, bundles, ignore []string) (unsafe.Pointer, int, *C.char, *C.char) {
+	ctx := context.Background()
+
+	recorder := &loadRecorder{
+		filter:  loaderFilter{Ignore: ignore}.Apply,
+		loaded:  make(map[string]struct{}),
+		ignored: make(map[string]struct{}),
+	}
+
+	bytes, err := compileWasm(ctx, 0, filteredWasmArgs(query, data, bundles, recorder.Apply)...)
+	if err != nil {
+		return nil, 0, nil, cError(err)
+	}
+
+	for _, bundleDir := range bundles {
+		recorder.loaded[bundleDir] = struct{}{}
+	}
+
+	rbytes, err := json.Marshal(recorder.report())
+	if err != nil {
+		return nil, 0, nil, cError(err)
+	}
+
+	return C.CBytes(bytes), len(bytes), C.CString(string(rbytes)), nil
+}
+
+// WasmBuildWithCapabilities is like WasmBuild, but fails the build if the
+// policy calls a builtin that is not listed in capabilitiesJSON. The
+// capabilities document has the same shape as the one returned by
+// RegoCapabilities; only the builtin names are used.
+//
+//export WasmBuildWithCapabilities
+func WasmBuildWithCapabilities(query string, data, bundles, ignore []string, capabilitiesJSON string) (unsafe.Pointer, int, *C.char) {
+	ctx := context.Background()
+
+	var caps capabilities
+	if err := json.Unmarshal([]byte(capabilitiesJSON), &caps); err != nil {
+		return nil, 0, cError(invalidArgument("invalid capabilities: %v", err))
+	}
+
+	regoArgs := append(wasmArgs(query, data, bundles, ignore), rego.UnsafeBuiltins(caps.unsafeBuiltins()))
+
+	bytes, err := compileWasm(ctx, 0, regoArgs...)
+	if err != nil {
+		return nil, 0, cError(err)
+	}
+
+	return C.CBytes(bytes), len(bytes), nil
+}
+
+// WasmBuildOptimized is like WasmBuild, but takes an optimization level
+// like opa build's -O flag. Any level above 0 partially evaluates the query
+// before compiling it; the embedded OPA has no finer-grained optimizations,
+// so levels 1 and 2 produce the same module.
+//
+//export WasmBuildOptimized
+func WasmBuildOptimized(query string, data, bundles, ignore []string, optimize int) (unsafe.Pointer, int, *C.char) {
+	ctx := context.Background()
+
+	if optimize < 0 {
+		return nil, 0, cError(invalidArgument("optimization level must not be negative, got %d", optimize))
+	}
+
+	bytes, err := compileWasm(ctx, optimize, wasmArgs(query, data, bundles, ignore)...)
+	if err != nil {
+		return nil, 0, cError(err)
+	}
+
+	return C.CBytes(bytes), len(bytes), nil
+}
+
+// WasmBuildBundle is like WasmBuild, but returns a gzipped tarball bundle
+// containing the compiled module as policy.wasm along with the data loaded
+// from data and bundles as data.json. The embedded OPA compiles a single
+// query per module, so the manifest carries no entrypoints.
+//
+//export WasmBuildBundle
+func WasmBuildBundle(query string, data, bundles, ignore []string) (unsafe.Pointer, int, *C.char) {
+	ctx := context.Background()
+
+	module, err := compileWasm(ctx, 0, wasmArgs(query, data, bundles, ignore)...)
+	if err != nil {
+		return nil, 0, cError(err)
+	}
+
+	docs, err := wasmData(data, bundles, ignore)
+	if err != nil {
+		return nil, 0, cError(err)
+	}
+
+	var buf bytes.Buffer
+	if err := bundle.Write(&buf, bundle.Bundle{Data: docs, Wasm: module}); err != nil {
+		return nil, 0, cError(err)
+	}
+
+	return C.CBytes(buf.Bytes()), buf.Len(), nil
+}
+
+// wasmData loads the documents that WasmBuild compiles against.
+func wasmData(data, bundles, ignore []string) (map[string]interface{}, error) {
+	f := loaderFilter{
+		Ignore: ignore,
+	}
+
+	docs := map[string]interface{}{}
+
+	if len(data) > 0 {
+		result, err := loader.Filtered(data, f.Apply)
+		if err != nil {
+			return nil, withCode(codeInvalidInput, err)
+		}
+		if err := mergeData(docs, result.Documents, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, bundleDir := range bundles {
+		b, err := loader.AsBundle(bundleDir)
+		if err != nil {
+			return nil, withCode(codeCompile, err)
+		}
+		if err := mergeData(docs, b.Data, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	return docs, nil
+}
+
+func mergeData(dst, src map[string]interface{}, path []string) error {
+	for k, v := range src {
+		existing, ok := dst[k]
+		if !ok {
+			dst[k] = v
+			continue
+		}
+
+		dstObj, ok1 := existing.(map[string]interface{})
+		srcObj, ok2 := v.(map[string]interface{})
+		if !ok1 || !ok2 {
+			return invalidArgument("conflicting data at /%s", strings.Join(append(path, k), "/"))
+		}
+
+		if err := mergeData(dstObj, srcObj, append(path, k)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func wasmArgs(query string, data, bundles, ignore []string) []func(*rego.Rego) {
+	f := loaderFilter{
+		Ignore: ignore,
+	}
+
+	return filteredWasmArgs(query, data, bundles, f.Apply)
+}
+
+func filteredWasmArgs(query string, data, bundles []string, filter loader.Filter) []func(*rego.Rego) {
+	regoArgs := []func(*rego.Rego){
+		rego.Query(query),
+	}
+
+	if len(data) > 0 {
+		regoArgs = append(regoArgs, rego.Load(data, filter))
+	}
+
+	for _, bundleDir := range bundles {
+		regoArgs = append(regoArgs, rego.LoadBundle(bundleDir))
+	}
+
+	return regoArgs
+}
+
+// WasmBuildFromModules is like WasmBuild, but compiles the modules names[i]
+// with contents[i] rather than loading them from disk.
+//
+//export WasmBuildFromModules
+func WasmBuildFromModules(query string, names []string, contents []string) (unsafe.Pointer, int, *C.char) {
+	ctx := context.Background()
+
+	if len(names) != len(contents) {
+		return nil, 0, cError(invalidArgument("got %d module names but %d module contents", len(names), len(contents)))
+	}
+
+	regoArgs := []func(*rego.Rego){
+		rego.Query(query),
+	}
+
+	for i := range names {
+		regoArgs = append(regoArgs, rego.Module(names[i], contents[i]))
+	}
+
+	bytes, err := compileWasm(ctx, 0, regoArgs...)
+	if err != nil {
+		return nil, 0, cError(err)
+	}
+
+	return C.CBytes(bytes), len(bytes), nil
+}
+
+func compileWasm(ctx context.Context, optimize int, regoArgs ...func(*rego.Rego)) ([]byte, error) {
+	cr, err := rego.New(regoArgs...).Compile(ctx, rego.CompilePartial(optimize > 0))
+	if err != nil {
+		return nil, withCode(codeCompile, err)
+	}
+
+	return cr.Bytes, nil
+}
+
+// Memory returned by this library is owned by the caller. Every non-nil
+// *C.char returned by an exported function, results and errors alike, must be
+// released with FreeCString, and every non-nil unsafe.Pointer with Free. A nil
+// pointer means there is nothing to free. Each non-nil pointer is allocated
+// with malloc for that call alone, never points into Go memory and is never
+// returned again, so it must be freed exactly once. A function returning both
+// a result and an error returns at most one of them non-nil.
+
+// Free releases a buffer returned by this library, such as the bytes returned
+// by WasmBuild or RegoEvalBytes.
+//
+//export Free
+func Free(ptr unsafe.Pointer) {
+	C.free(ptr)
+}
+
+// FreeCString releases a string returned by this library, such as the result
+// of RegoEval or any error. It is a no-op for nil.
+//
+//export FreeCString
+func FreeCString(s *C.char) {
+	C.free(unsafe.Pointer(s))
 }
 
 func main() {}
@@ -1,6 +1,36 @@
 package main
 
-import "testing"
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func decodeError(t *testing.T, msg string) cerror {
+	t.Helper()
+
+	var e cerror
+	if err := json.Unmarshal([]byte(msg), &e); err != nil {
+		t.Fatalf("could not unmarshal error %q: %v", msg, err)
+	}
+
+	return e
+}
+
+// resetRegistry drops every query and restarts ids from 1, so that tests
+// asserting on ids do not depend on which tests ran before them.
+func resetRegistry() {
+	defaultEvaluator = newEvaluator()
+}
 
 func TestRegoNew(t *testing.T) {
 	query := "data.example.allow"
@@ -9,6 +39,8 @@ func TestRegoNew(t *testing.T) {
 
 	default allow = false`
 
+	resetRegistry()
+
 	n, err := RegoNew(query, modulename, modulecontent)
 	if err != nil {
 		t.Errorf("err is not nil: %v", err)
@@ -27,15 +59,69 @@ func TestRegoNew(t *testing.T) {
 		t.Errorf("second id: got %d, expected %d", n2, 2)
 	}
 
-	if len(registry) != 2 {
-		t.Errorf("registry length: got %d, expected %d", len(registry), 2)
+	if len(defaultEvaluator.registry) != 2 {
+		t.Errorf("registry length: got %d, expected %d", len(defaultEvaluator.registry), 2)
 	}
 
 	// Drop one
 	RegoDrop(2)
 
-	if len(registry) != 1 {
-		t.Errorf("registry length: got %d, expected %d", len(registry), 1)
+	if len(defaultEvaluator.registry) != 1 {
+		t.Errorf("registry length: got %d, expected %d", len(defaultEvaluator.registry), 1)
+	}
+}
+
+func TestRegoDropAll(t *testing.T) {
+	query := "data.example.allow"
+	modulename := "example.rego"
+	modulecontent := `package example
+
+	default allow = false`
+
+	id, err := RegoNew(query, modulename, modulecontent)
+	if err != nil {
+		t.Errorf("err is not nil: %v", goString(err))
+	}
+
+	RegoDropAll()
+
+	if len(defaultEvaluator.registry) != 0 {
+		t.Errorf("registry length: got %d, expected %d", len(defaultEvaluator.registry), 0)
+	}
+
+	_, err = RegoEvalBool(id, `{}`)
+	if e := decodeError(t, goString(err)); e.Code != codeNotFound {
+		t.Errorf("code: got %v, expected %v", e.Code, codeNotFound)
+	}
+}
+
+func TestRegoListIds(t *testing.T) {
+	query := "data.example.allow"
+	modulename := "example.rego"
+	modulecontent := `package example
+
+	default allow = false`
+
+	resetRegistry()
+
+	for i := 0; i < 3; i++ {
+		if _, err := RegoNew(query, modulename, modulecontent); err != nil {
+			t.Fatalf("err is not nil: %v", goString(err))
+		}
+	}
+	RegoDrop(2)
+
+	list, err := RegoListIds()
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+
+	if goString(list) != "[1,3]" {
+		t.Errorf("ids: got %s, expected %s", goString(list), "[1,3]")
+	}
+
+	if count := RegoCount(); count != 2 {
+		t.Errorf("count: got %d, expected %d", count, 2)
 	}
 }
 
@@ -105,3 +191,3923 @@ func TestRegoEvalBool_undefined(t *testing.T) {
 		t.Errorf("isdefined: got %v, expected %v", isdefined, expected)
 	}
 }
+
+func TestRegoEvalBoolStrict(t *testing.T) {
+	modulename := "example.rego"
+	modulecontent := `package example
+
+	default allow = false
+
+	config = {}
+
+	roles = ["admin", "user"]`
+
+	tests := []struct {
+		query  string
+		value  bool
+		isBool bool
+	}{
+		{"data.example.allow", false, true},
+		{"data.example.config", false, false},
+		{"data.example.missing", false, false},
+		{"data.example.roles[_]", false, false},
+	}
+
+	for _, tc := range tests {
+		id, err := RegoNew(tc.query, modulename, modulecontent)
+		if err != nil {
+			t.Fatalf("err is not nil: %v", goString(err))
+		}
+
+		value, isBool, err := RegoEvalBoolStrict(id, `{}`)
+		if err != nil {
+			t.Errorf("err is not nil: %v", goString(err))
+		}
+
+		if value != tc.value || isBool != tc.isBool {
+			t.Errorf("%v: got %v (isBool %v), expected %v (isBool %v)", tc.query, value, isBool, tc.value, tc.isBool)
+		}
+
+		RegoDrop(id)
+	}
+}
+
+func TestRegoEvalBoolDefined(t *testing.T) {
+	modulename := "example.rego"
+	modulecontent := `package example
+
+	default allow = false
+
+	deny { input.user == "eve" }`
+
+	tests := []struct {
+		query   string
+		value   bool
+		defined bool
+	}{
+		{"data.example.allow", false, true},
+		{"data.example.deny", false, false},
+	}
+
+	for _, tc := range tests {
+		id, err := RegoNew(tc.query, modulename, modulecontent)
+		if err != nil {
+			t.Fatalf("err is not nil: %v", goString(err))
+		}
+
+		value, defined, err := RegoEvalBoolDefined(id, `{"user": "alice"}`)
+		if err != nil {
+			t.Errorf("err is not nil: %v", goString(err))
+		}
+
+		if value != tc.value || defined != tc.defined {
+			t.Errorf("%v: got %v (defined %v), expected %v (defined %v)", tc.query, value, defined, tc.value, tc.defined)
+		}
+
+		RegoDrop(id)
+	}
+}
+
+func TestRegoEvalString(t *testing.T) {
+	query := "data.example.reason"
+	modulename := "example.rego"
+	modulecontent := `package example
+
+	default reason = "denied"`
+
+	id, err := RegoNew(query, modulename, modulecontent)
+	if err != nil {
+		t.Errorf("err is not nil: %v", err)
+	}
+
+	s, err := RegoEvalString(id, `{"test": 1}`)
+	if err != nil {
+		t.Errorf("err is not nil: %v", err)
+	}
+
+	expected := "denied"
+	if s == nil || goString(s) != expected {
+		t.Errorf("reason: got %v, expected %v", s, expected)
+	}
+}
+
+func TestRegoEvalString_undefined(t *testing.T) {
+	query := "data.example.reason"
+	modulename := "example.rego"
+	modulecontent := `package example
+
+	default reason = 1`
+
+	id, err := RegoNew(query, modulename, modulecontent)
+	if err != nil {
+		t.Errorf("err is not nil: %v", err)
+	}
+
+	s, err := RegoEvalString(id, `{"test": 1}`)
+	if err != nil {
+		t.Errorf("err is not nil: %v", err)
+	}
+
+	if s != nil {
+		t.Errorf("reason: got %v, expected nil", goString(s))
+	}
+}
+
+func TestRegoEvalFloat(t *testing.T) {
+	query := "data.example.score"
+	modulename := "example.rego"
+	modulecontent := `package example
+
+	default score = 0.75`
+
+	id, err := RegoNew(query, modulename, modulecontent)
+	if err != nil {
+		t.Errorf("err is not nil: %v", err)
+	}
+
+	f, defined, err := RegoEvalFloat(id, `{"test": 1}`)
+	if err != nil {
+		t.Errorf("err is not nil: %v", err)
+	}
+
+	if !defined || f != 0.75 {
+		t.Errorf("score: got %v (defined %v), expected %v", f, defined, 0.75)
+	}
+}
+
+func TestRegoEvalInt(t *testing.T) {
+	query := "data.example.ttl"
+	modulename := "example.rego"
+	modulecontent := `package example
+
+	default ttl = 30`
+
+	id, err := RegoNew(query, modulename, modulecontent)
+	if err != nil {
+		t.Errorf("err is not nil: %v", err)
+	}
+
+	i, defined, err := RegoEvalInt(id, `{"test": 1}`)
+	if err != nil {
+		t.Errorf("err is not nil: %v", err)
+	}
+
+	if !defined || i != 30 {
+		t.Errorf("ttl: got %v (defined %v), expected %v", i, defined, 30)
+	}
+}
+
+func TestRegoEvalInt_fractional(t *testing.T) {
+	query := "data.example.ttl"
+	modulename := "example.rego"
+	modulecontent := `package example
+
+	default ttl = 2.5`
+
+	id, err := RegoNew(query, modulename, modulecontent)
+	if err != nil {
+		t.Errorf("err is not nil: %v", err)
+	}
+
+	_, defined, err := RegoEvalInt(id, `{"test": 1}`)
+	if err != nil {
+		t.Errorf("err is not nil: %v", err)
+	}
+
+	if defined {
+		t.Errorf("defined: got %v, expected %v", defined, false)
+	}
+}
+
+func TestRegoEvalCount(t *testing.T) {
+	query := "data.example.admins[name]"
+	modulename := "example.rego"
+	modulecontent := `package example
+
+	admins[name] { input.users[name].admin }`
+
+	id, err := RegoNew(query, modulename, modulecontent)
+	if err != nil {
+		t.Errorf("err is not nil: %v", goString(err))
+	}
+
+	count, err := RegoEvalCount(id, `{"users": {"alice": {"admin": true}, "bob": {"admin": true}, "eve": {"admin": false}}}`)
+	if err != nil {
+		t.Errorf("err is not nil: %v", goString(err))
+	}
+
+	if count != 2 {
+		t.Errorf("count: got %v, expected %v", count, 2)
+	}
+}
+
+func TestRegoEvalNoInput(t *testing.T) {
+	query := "data.example.state"
+	modulename := "example.rego"
+	modulecontent := `package example
+
+	default state = "undefined"
+
+	state = "null" { input == null }
+
+	state = "empty" { input == {} }`
+
+	id, err := RegoNew(query, modulename, modulecontent)
+	if err != nil {
+		t.Errorf("err is not nil: %v", goString(err))
+	}
+
+	result, err := RegoEvalNoInput(id)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+
+	if !strings.Contains(goString(result), `"value":"undefined"`) {
+		t.Errorf("result: got %s, expected input to be undefined", goString(result))
+	}
+
+	state, err := RegoEvalString(id, `null`)
+	if err != nil {
+		t.Errorf("err is not nil: %v", goString(err))
+	}
+	if goString(state) != "null" {
+		t.Errorf("state: got %v, expected %v", goString(state), "null")
+	}
+}
+
+func TestRegoEvalBytesInput(t *testing.T) {
+	query := "data.example.name"
+	modulename := "example.rego"
+	modulecontent := `package example
+
+	name = input.name`
+
+	id, err := RegoNew(query, modulename, modulecontent)
+	if err != nil {
+		t.Errorf("err is not nil: %v", goString(err))
+	}
+
+	// Only the first len(input) bytes of the buffer may be read.
+	input := `{"name": "a\u0000b"}`
+	buf := []byte(input + "garbage")
+
+	result, err := RegoEvalBytesInput(id, unsafe.Pointer(&buf[0]), len(input))
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+
+	var results []struct {
+		Expressions []struct {
+			Value string `json:"value"`
+		} `json:"expressions"`
+	}
+	if err := json.Unmarshal([]byte(goString(result)), &results); err != nil {
+		t.Fatalf("could not unmarshal results: %v", err)
+	}
+
+	expected := "a\x00b"
+	if len(results) != 1 || results[0].Expressions[0].Value != expected {
+		t.Errorf("value: got %q, expected %q", results, expected)
+	}
+}
+
+func TestRegoEvalAtPath(t *testing.T) {
+	query := "data.example.allow"
+	modulename := "example.rego"
+	modulecontent := `package example
+
+	allow { input.request.user == "admin" }`
+
+	id, err := RegoNew(query, modulename, modulecontent)
+	if err != nil {
+		t.Errorf("err is not nil: %v", goString(err))
+	}
+
+	result, err := RegoEvalAtPath(id, "/request", `{"user": "admin"}`)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+
+	var results []struct {
+		Expressions []struct {
+			Value bool `json:"value"`
+		} `json:"expressions"`
+	}
+	if err := json.Unmarshal([]byte(goString(result)), &results); err != nil {
+		t.Fatalf("could not unmarshal results: %v", err)
+	}
+
+	if len(results) != 1 || !results[0].Expressions[0].Value {
+		t.Errorf("results: got %s, expected allow to be true", goString(result))
+	}
+}
+
+func TestRegoEvalBytes_nul(t *testing.T) {
+	query := "data.example.value"
+	modulename := "example.rego"
+	modulecontent := `package example
+
+	default value = "a\u0000b"`
+
+	id, err := RegoNew(query, modulename, modulecontent)
+	if err != nil {
+		t.Errorf("err is not nil: %v", err)
+	}
+
+	ptr, n, err := RegoEvalBytes(id, `{"test": 1}`)
+	if err != nil {
+		t.Errorf("err is not nil: %v", err)
+	}
+	defer Free(ptr)
+
+	var results []struct {
+		Expressions []struct {
+			Value string `json:"value"`
+		} `json:"expressions"`
+	}
+	if err := json.Unmarshal(goBytes(ptr, n), &results); err != nil {
+		t.Fatalf("could not unmarshal results: %v", err)
+	}
+
+	expected := "a\x00b"
+	if len(results) != 1 || results[0].Expressions[0].Value != expected {
+		t.Errorf("value: got %q, expected %q", results, expected)
+	}
+}
+
+func TestRegoNew_wraparound(t *testing.T) {
+	query := "data.example.allow"
+	modulename := "example.rego"
+	modulecontent := `package example
+
+	default allow = false`
+
+	first, err := RegoNew(query, modulename, modulecontent)
+	if err != nil {
+		t.Errorf("err is not nil: %v", err)
+	}
+
+	defaultEvaluator.mutex.Lock()
+	saved := defaultEvaluator.ids
+	defaultEvaluator.ids = first - 1
+	defaultEvaluator.mutex.Unlock()
+
+	id, err := RegoNew(query, modulename, modulecontent)
+	if err != nil {
+		t.Errorf("err is not nil: %v", err)
+	}
+
+	if id == first {
+		t.Errorf("id: got %d, which is still registered", id)
+	}
+
+	defaultEvaluator.mutex.Lock()
+	defaultEvaluator.ids = ^uint64(0)
+	defaultEvaluator.mutex.Unlock()
+
+	id, err = RegoNew(query, modulename, modulecontent)
+	if err != nil {
+		t.Errorf("err is not nil: %v", err)
+	}
+
+	if id == 0 {
+		t.Errorf("id: got 0 after wraparound")
+	}
+
+	defaultEvaluator.mutex.Lock()
+	defaultEvaluator.ids = saved
+	savedMax := maxQueries
+	maxQueries = len(defaultEvaluator.registry)
+	defaultEvaluator.mutex.Unlock()
+	defer func() {
+		defaultEvaluator.mutex.Lock()
+		maxQueries = savedMax
+		defaultEvaluator.mutex.Unlock()
+	}()
+
+	_, err = RegoNew(query, modulename, modulecontent)
+	if err == nil {
+		t.Fatal("expected error with every id taken")
+	}
+	if e := decodeError(t, goString(err)); e.Code != codeResourceLimit {
+		t.Errorf("code: got %v, expected %v", e.Code, codeResourceLimit)
+	}
+}
+
+func TestRegoNewInterned(t *testing.T) {
+	query := "data.example.allow"
+	modulename := "example.rego"
+	modulecontent := `package example
+
+	default allow = true`
+
+	id, err := RegoNewInterned(query, modulename, modulecontent)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+
+	same, err := RegoNewInterned(query, modulename, modulecontent)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+	if same != id {
+		t.Errorf("id: got %v, expected %v", same, id)
+	}
+
+	other, err := RegoNewInterned(query, modulename, modulecontent+"\n")
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+	defer RegoDrop(other)
+	if other == id {
+		t.Errorf("id: got %v for different content, expected a new id", other)
+	}
+
+	RegoDrop(id)
+	allowed, err := RegoEvalBool(id, `{}`)
+	if err != nil {
+		t.Fatalf("err is not nil after first drop: %v", goString(err))
+	}
+	if !allowed {
+		t.Errorf("allowed: got %v, expected %v", allowed, true)
+	}
+
+	RegoDrop(id)
+	_, err = RegoEvalBool(id, `{}`)
+	if err == nil {
+		t.Fatal("expected error after last drop")
+	}
+	if e := decodeError(t, goString(err)); e.Code != codeNotFound {
+		t.Errorf("code: got %v, expected %v", e.Code, codeNotFound)
+	}
+
+	fresh, err := RegoNewInterned(query, modulename, modulecontent)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+	defer RegoDrop(fresh)
+	if fresh == id {
+		t.Errorf("id: got dropped id %v, expected a new id", fresh)
+	}
+}
+
+func TestRegoRetain(t *testing.T) {
+	query := "data.example.allow"
+	modulename := "example.rego"
+	modulecontent := `package example
+
+	default allow = true`
+
+	id, err := RegoNew(query, modulename, modulecontent)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+
+	if err := RegoRetain(id); err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+
+	RegoDrop(id)
+	if _, err := RegoEvalBool(id, `{}`); err != nil {
+		t.Fatalf("err is not nil after first drop: %v", goString(err))
+	}
+
+	RegoDrop(id)
+	_, err = RegoEvalBool(id, `{}`)
+	if err == nil {
+		t.Fatal("expected error after last drop")
+	}
+	if e := decodeError(t, goString(err)); e.Code != codeNotFound {
+		t.Errorf("code: got %v, expected %v", e.Code, codeNotFound)
+	}
+
+	err = RegoRetain(id)
+	if err == nil {
+		t.Fatal("expected error retaining a dropped id")
+	}
+	if e := decodeError(t, goString(err)); e.Code != codeNotFound {
+		t.Errorf("code: got %v, expected %v", e.Code, codeNotFound)
+	}
+}
+
+func TestRegoNewCompressed(t *testing.T) {
+	query := "data.example.allow"
+	modulename := "example.rego"
+	modulecontent := `package example
+
+	default allow = true`
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	if _, err := gw.Write([]byte(modulecontent)); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	compressed := buf.Bytes()
+
+	id, err := RegoNewCompressed(query, modulename, unsafe.Pointer(&compressed[0]), len(compressed))
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+	defer RegoDrop(id)
+
+	allowed, err := RegoEvalBool(id, `{}`)
+	if err != nil {
+		t.Errorf("err is not nil: %v", goString(err))
+	}
+	if !allowed {
+		t.Errorf("allowed: got %v, expected %v", allowed, true)
+	}
+
+	plain := []byte(modulecontent)
+	_, err = RegoNewCompressed(query, modulename, unsafe.Pointer(&plain[0]), len(plain))
+	if err == nil {
+		t.Fatal("expected error for uncompressed content")
+	}
+	if e := decodeError(t, goString(err)); e.Code != codeInvalidInput {
+		t.Errorf("code: got %v, expected %v", e.Code, codeInvalidInput)
+	}
+}
+
+func TestRegoNewBounded(t *testing.T) {
+	query := "data.example.allow"
+	modulename := "example.rego"
+	modulecontent := `package example
+
+	allow { input.role == "admin" }`
+
+	id, err := RegoNewBounded(query, modulename, modulecontent, len(modulecontent), 100)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+	RegoDrop(id)
+
+	for _, limits := range [][2]int{{len(modulecontent) - 1, 0}, {0, 3}} {
+		_, err := RegoNewBounded(query, modulename, modulecontent, limits[0], limits[1])
+		if err == nil {
+			t.Fatalf("limits %v: expected error", limits)
+		}
+		if e := decodeError(t, goString(err)); e.Code != codeTooLarge {
+			t.Errorf("limits %v: code: got %v, expected %v", limits, e.Code, codeTooLarge)
+		}
+	}
+}
+
+func TestRegoNewModules(t *testing.T) {
+	query := "data.example.allow"
+	names := []string{"example.rego", "helpers.rego"}
+	contents := []string{
+		`package example
+
+		import data.helpers
+
+		allow { helpers.is_admin }`,
+		`package helpers
+
+		is_admin { input.role == "admin" }`,
+	}
+
+	id, err := RegoNewModules(query, names, contents)
+	if err != nil {
+		t.Errorf("err is not nil: %v", goString(err))
+	}
+
+	allowed, err := RegoEvalBool(id, `{"role": "admin"}`)
+	if err != nil {
+		t.Errorf("err is not nil: %v", goString(err))
+	}
+
+	if !allowed {
+		t.Errorf("allowed: got %v, expected %v", allowed, true)
+	}
+}
+
+func TestRegoNewModules_error(t *testing.T) {
+	query := "data.example.allow"
+	names := []string{"example.rego", "broken.rego"}
+	contents := []string{
+		`package example
+
+		default allow = false`,
+		`package broken
+
+		deny { x }`,
+	}
+
+	_, err := RegoNewModules(query, names, contents)
+	if err == nil {
+		t.Fatalf("err is nil")
+	}
+
+	if msg := goString(err); !strings.Contains(msg, "broken.rego") {
+		t.Errorf("error %q does not name broken.rego", msg)
+	}
+}
+
+func TestRegoNewFromCompiler(t *testing.T) {
+	token, err := RegoCompileModules(
+		[]string{"authz.rego", "roles.rego"},
+		[]string{`package authz
+
+		allow { data.roles.admins[_] == input.user }
+		deny { not allow }`, `package roles
+
+		admins = ["alice"]`},
+	)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+
+	allowID, err := RegoNewFromCompiler(token, "data.authz.allow")
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+	defer RegoDrop(allowID)
+
+	denyID, err := RegoNewFromCompiler(token, "data.authz.deny")
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+	defer RegoDrop(denyID)
+
+	RegoDropCompiler(token)
+
+	for _, tc := range []struct {
+		id       uint64
+		input    string
+		expected bool
+	}{
+		{allowID, `{"user": "alice"}`, true},
+		{allowID, `{"user": "bob"}`, false},
+		{denyID, `{"user": "bob"}`, true},
+	} {
+		allowed, err := RegoEvalBool(tc.id, tc.input)
+		if err != nil {
+			t.Fatalf("err is not nil: %v", goString(err))
+		}
+		if allowed != tc.expected {
+			t.Errorf("query %d with %s: got %v, expected %v", tc.id, tc.input, allowed, tc.expected)
+		}
+	}
+
+	_, err = RegoNewFromCompiler(token, "data.authz.allow")
+	if err == nil {
+		t.Fatal("expected error for dropped compiler")
+	}
+	if e := decodeError(t, goString(err)); e.Code != codeNotFound {
+		t.Errorf("code: got %v, expected %v", e.Code, codeNotFound)
+	}
+
+	_, err = RegoCompileModules([]string{"broken.rego"}, []string{`package broken
+
+	allow { x }`})
+	if err == nil {
+		t.Fatal("expected error for invalid module")
+	}
+	if e := decodeError(t, goString(err)); e.Code != codeCompile {
+		t.Errorf("code: got %v, expected %v", e.Code, codeCompile)
+	}
+}
+
+func TestRegoNewWithData(t *testing.T) {
+	query := "data.example.allow"
+	modulename := "example.rego"
+	modulecontent := `package example
+
+	allow { data.config.users[_] == input.user }`
+
+	id, err := RegoNewWithData(query, modulename, modulecontent, `{"config": {"users": ["alice"]}}`)
+	if err != nil {
+		t.Errorf("err is not nil: %v", goString(err))
+	}
+
+	for _, tc := range []struct {
+		input    string
+		expected bool
+	}{
+		{`{"user": "alice"}`, true},
+		{`{"user": "bob"}`, false},
+		{`{"user": "alice"}`, true},
+	} {
+		allowed, err := RegoEvalBool(id, tc.input)
+		if err != nil {
+			t.Errorf("err is not nil: %v", goString(err))
+		}
+
+		if allowed != tc.expected {
+			t.Errorf("allowed for %s: got %v, expected %v", tc.input, allowed, tc.expected)
+		}
+	}
+}
+
+func TestRegoNewWithDataPaths(t *testing.T) {
+	query := "data.example.allow"
+	modulename := "example.rego"
+	modulecontent := `package example
+
+	allow { data.config.users[_] == input.user; data.flags.enabled; data.config.region == "eu" }`
+
+	id, err := RegoNewWithDataPaths(query, modulename, modulecontent,
+		[]string{"/config", "/flags", "/config/region"},
+		[]string{`{"users": ["alice"]}`, `{"enabled": true}`, `"eu"`},
+	)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+	defer RegoDrop(id)
+
+	allowed, err := RegoEvalBool(id, `{"user": "alice"}`)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+	if !allowed {
+		t.Errorf("allowed: got %v, expected %v", allowed, true)
+	}
+
+	_, err = RegoNewWithDataPaths(query, modulename, modulecontent,
+		[]string{"/config/region", "/config"},
+		[]string{`"eu"`, `{"region": "us"}`},
+	)
+	if err == nil {
+		t.Fatal("expected error for conflicting paths")
+	}
+	e := decodeError(t, goString(err))
+	if e.Code != codeInvalidArgument || !strings.Contains(e.Message, "/config/region") {
+		t.Errorf("error: got %s, expected a conflict at /config/region", goString(err))
+	}
+
+	_, err = RegoNewWithDataPaths(query, modulename, modulecontent, []string{"/config"}, nil)
+	if err == nil {
+		t.Fatal("expected error for mismatched lengths")
+	}
+	if e := decodeError(t, goString(err)); e.Code != codeInvalidArgument {
+		t.Errorf("code: got %v, expected %v", e.Code, codeInvalidArgument)
+	}
+}
+
+// borrowedString returns a string sharing buf's memory, like the strings cgo
+// passes in, which point at memory the caller owns.
+func borrowedString(buf []byte) string {
+	return *(*string)(unsafe.Pointer(&buf))
+}
+
+func TestRegoNewWithDataPaths_borrowedPaths(t *testing.T) {
+	buf := []byte("/config")
+
+	id, err := RegoNewWithDataPaths("data.config.region", "example.rego", "package example",
+		[]string{borrowedString(buf)},
+		[]string{`{"region": "eu"}`},
+	)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+	defer RegoDrop(id)
+
+	// The caller reuses its buffer once the call returns.
+	copy(buf, "/xxxxxx")
+
+	result, err := RegoEval(id, `{}`)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+	if !strings.Contains(goString(result), `"value":"eu"`) {
+		t.Errorf("result: got %s, expected the region at /config", goString(result))
+	}
+}
+
+func TestRegoNewFromPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "opa-path")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"example/policy.rego": `package example
+
+		allow { input.user == data.example.admin }`,
+		"example/data.json":   `{"admin": "alice"}`,
+		"scratch/broken.rego": `package`,
+	}
+
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	id, cerr := RegoNewFromPath("data.example.allow", []string{dir}, []string{"scratch"})
+	if cerr != nil {
+		t.Fatalf("err is not nil: %v", goString(cerr))
+	}
+	defer RegoDrop(id)
+
+	allowed, cerr := RegoEvalBool(id, `{"user": "alice"}`)
+	if cerr != nil {
+		t.Errorf("err is not nil: %v", goString(cerr))
+	}
+	if !allowed {
+		t.Errorf("allowed: got %v, expected %v", allowed, true)
+	}
+}
+
+func TestRegoNewRestricted(t *testing.T) {
+	query := "data.example.allow"
+	modulename := "example.rego"
+	modulecontent := `package example
+
+	allow {
+		http.send({"method": "get", "url": "http://localhost"}).status_code == 200
+	}`
+
+	_, err := RegoNewRestricted(query, modulename, modulecontent, `["http.send"]`)
+	if err == nil {
+		t.Fatal("expected error for blocked builtin")
+	}
+
+	e := decodeError(t, goString(err))
+	if e.Code != codeCompile {
+		t.Errorf("code: got %v, expected %v", e.Code, codeCompile)
+	}
+	if !strings.Contains(e.Message, "http.send") {
+		t.Errorf("message: got %v, expected it to name http.send", e.Message)
+	}
+
+	id, err := RegoNewRestricted(query, modulename, `package example
+
+	allow { input.user == "admin" }`, `["http.send"]`)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+	defer RegoDrop(id)
+
+	allowed, err := RegoEvalBool(id, `{"user": "admin"}`)
+	if err != nil {
+		t.Errorf("err is not nil: %v", goString(err))
+	}
+	if !allowed {
+		t.Errorf("allowed: got %v, expected %v", allowed, true)
+	}
+}
+
+func TestRegoNewWithIndexing(t *testing.T) {
+	query := "data.example.allow"
+	modulename := "example.rego"
+	modulecontent := `package example
+
+	allow { input.role == "admin" }
+	allow { input.role == "owner"; input.user == input.resource.owner }
+	allow { input.method == "GET"; input.path = ["public", _] }`
+
+	indexed, err := RegoNewWithIndexing(query, modulename, modulecontent, false)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+	defer RegoDrop(indexed)
+
+	unindexed, err := RegoNewWithIndexing(query, modulename, modulecontent, true)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+	defer RegoDrop(unindexed)
+
+	if !defaultEvaluator.registry[unindexed].options.disableIndexing {
+		t.Errorf("disableIndexing: got %v, expected %v", false, true)
+	}
+
+	for _, input := range []string{
+		`{"role": "admin"}`,
+		`{"role": "owner", "user": "alice", "resource": {"owner": "alice"}}`,
+		`{"role": "owner", "user": "bob", "resource": {"owner": "alice"}}`,
+		`{"method": "GET", "path": ["public", "index.html"]}`,
+		`{"method": "POST", "path": ["public", "index.html"]}`,
+		`{}`,
+	} {
+		expected, err := RegoEval(indexed, input)
+		if err != nil {
+			t.Fatalf("%s: err is not nil: %v", input, goString(err))
+		}
+		actual, err := RegoEval(unindexed, input)
+		if err != nil {
+			t.Fatalf("%s: err is not nil: %v", input, goString(err))
+		}
+		if goString(actual) != goString(expected) {
+			t.Errorf("%s: got %s without indexing, expected %s", input, goString(actual), goString(expected))
+		}
+	}
+}
+
+func TestRegoNewWithRuntime(t *testing.T) {
+	query := "data.example.region"
+	modulename := "example.rego"
+	modulecontent := `package example
+
+	region = opa.runtime().region`
+
+	id, err := RegoNewWithRuntime(query, modulename, modulecontent, `{"region": "us-west"}`)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+	defer RegoDrop(id)
+
+	region, err := RegoEvalString(id, `{}`)
+	if err != nil {
+		t.Errorf("err is not nil: %v", goString(err))
+	}
+
+	if goString(region) != "us-west" {
+		t.Errorf("region: got %v, expected %v", goString(region), "us-west")
+	}
+}
+
+func TestRegoNewMultiQuery(t *testing.T) {
+	queries := []string{"data.example.allow", "data.example.reason"}
+	names := []string{"example.rego"}
+	contents := []string{`package example
+
+	default allow = false
+
+	allow { input.role == "admin" }
+
+	reason = "not an admin" { not allow }`}
+
+	ids := make([]uint64, len(queries))
+	if err := RegoNewMultiQuery(queries, names, contents, ids); err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+	defer RegoDrop(ids[0])
+	defer RegoDrop(ids[1])
+
+	allowed, err := RegoEvalBool(ids[0], `{"role": "user"}`)
+	if err != nil {
+		t.Errorf("err is not nil: %v", goString(err))
+	}
+	if allowed {
+		t.Errorf("allowed: got %v, expected %v", allowed, false)
+	}
+
+	reason, err := RegoEvalString(ids[1], `{"role": "user"}`)
+	if err != nil {
+		t.Errorf("err is not nil: %v", goString(err))
+	}
+	if goString(reason) != "not an admin" {
+		t.Errorf("reason: got %v, expected %v", goString(reason), "not an admin")
+	}
+
+	count := RegoCount()
+	err = RegoNewMultiQuery([]string{"data.example.allow", "data.example.allow["}, names, contents, ids)
+	if err == nil {
+		t.Fatal("expected error for invalid query")
+	}
+	if RegoCount() != count {
+		t.Errorf("count: got %d, expected no queries to be registered", RegoCount())
+	}
+}
+
+func TestRegoNewFromBundle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "opa-bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"example/policy.rego": `package example
+
+		allow { data.example.users[_] == input.user }`,
+		"example/data.json": `{"users": ["alice"]}`,
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	id, cerr := RegoNewFromBundle("data.example.allow", dir)
+	if cerr != nil {
+		t.Fatalf("err is not nil: %v", goString(cerr))
+	}
+
+	allowed, cerr := RegoEvalBool(id, `{"user": "alice"}`)
+	if cerr != nil {
+		t.Errorf("err is not nil: %v", goString(cerr))
+	}
+
+	if !allowed {
+		t.Errorf("allowed: got %v, expected %v", allowed, true)
+	}
+}
+
+func TestRegoEvalDefault(t *testing.T) {
+	dir, err := ioutil.TempDir("", "opa-bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		".manifest": `{"revision": "abc", "roots": ["system", "example"]}`,
+		"system/main.rego": `package system
+
+		main = data.example.allow`,
+		"example/policy.rego": `package example
+
+		allow { input.user == "alice" }`,
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	id, cerr := RegoNewFromBundle("data", dir)
+	if cerr != nil {
+		t.Fatalf("err is not nil: %v", goString(cerr))
+	}
+	defer RegoDrop(id)
+
+	for _, tc := range []struct {
+		input    string
+		expected string
+	}{
+		{`{"user": "alice"}`, `{"result":true}`},
+		{`{"user": "bob"}`, `{}`},
+	} {
+		result, cerr := RegoEvalDefault(id, tc.input)
+		if cerr != nil {
+			t.Fatalf("err is not nil: %v", goString(cerr))
+		}
+
+		if goString(result) != tc.expected {
+			t.Errorf("decision for %s: got %s, expected %s", tc.input, goString(result), tc.expected)
+		}
+	}
+}
+
+func TestRegoEvalWithProvenance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "opa-bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		".manifest": `{"revision": "2020-03-01"}`,
+		"example/policy.rego": `package example
+
+		allow = true`,
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	id, cerr := RegoNewFromBundle("data.example.allow", dir)
+	if cerr != nil {
+		t.Fatalf("err is not nil: %v", goString(cerr))
+	}
+	defer RegoDrop(id)
+
+	result, prov, cerr := RegoEvalWithProvenance(id, `{}`)
+	if cerr != nil {
+		t.Fatalf("err is not nil: %v", goString(cerr))
+	}
+	if !strings.Contains(goString(result), `"value":true`) {
+		t.Errorf("result: got %s, expected allow to be true", goString(result))
+	}
+
+	var p struct {
+		Version  string `json:"version"`
+		Revision string `json:"revision"`
+	}
+	if err := json.Unmarshal([]byte(goString(prov)), &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Version != goString(OpaVersion()) || p.Revision != "2020-03-01" {
+		t.Errorf("provenance: got %s, expected version %s and revision 2020-03-01", goString(prov), goString(OpaVersion()))
+	}
+
+	other, cerr := RegoNew("data.example.allow", "example.rego", `package example
+
+	allow = true`)
+	if cerr != nil {
+		t.Fatalf("err is not nil: %v", goString(cerr))
+	}
+	defer RegoDrop(other)
+
+	_, prov, cerr = RegoEvalWithProvenance(other, `{}`)
+	if cerr != nil {
+		t.Fatalf("err is not nil: %v", goString(cerr))
+	}
+	if strings.Contains(goString(prov), "revision") {
+		t.Errorf("provenance: got %s, expected no revision", goString(prov))
+	}
+}
+
+func TestRegoSetData(t *testing.T) {
+	query := "data.example.allow"
+	modulename := "example.rego"
+	modulecontent := `package example
+
+	allow { not data.revoked[input.token] }`
+
+	id, err := RegoNew(query, modulename, modulecontent)
+	if err != nil {
+		t.Errorf("err is not nil: %v", goString(err))
+	}
+
+	assertAllowed := func(expected bool) {
+		t.Helper()
+		allowed, err := RegoEvalBool(id, `{"token": "abc"}`)
+		if err != nil {
+			t.Errorf("err is not nil: %v", goString(err))
+		}
+
+		if allowed != expected {
+			t.Errorf("allowed: got %v, expected %v", allowed, expected)
+		}
+	}
+
+	assertAllowed(true)
+
+	if err := RegoSetData(id, "/revoked/abc", "true"); err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+	assertAllowed(false)
+
+	if err := RegoRemoveData(id, "/revoked/abc"); err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+	assertAllowed(true)
+}
+
+func TestRegoPatchData(t *testing.T) {
+	query := "data.example.allow"
+	modulename := "example.rego"
+	modulecontent := `package example
+
+	allow { not data.revoked[input.token]; data.flags.enabled }`
+
+	id, err := RegoNewWithData(query, modulename, modulecontent, `{"revoked": {}, "flags": {"enabled": false}}`)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+	defer RegoDrop(id)
+
+	assertAllowed := func(token string, expected bool) {
+		t.Helper()
+		allowed, err := RegoEvalBool(id, fmt.Sprintf(`{"token": %q}`, token))
+		if err != nil {
+			t.Errorf("err is not nil: %v", goString(err))
+		}
+
+		if allowed != expected {
+			t.Errorf("allowed for %s: got %v, expected %v", token, allowed, expected)
+		}
+	}
+
+	err = RegoPatchData(id, `[
+		{"op": "replace", "path": "/flags/enabled", "value": true},
+		{"op": "add", "path": "/revoked/abc", "value": true},
+		{"op": "add", "path": "/revoked/a~1b", "value": true}
+	]`)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+	assertAllowed("abc", false)
+	assertAllowed("a/b", false)
+	assertAllowed("def", true)
+
+	// The failing remove rolls back the add before it.
+	err = RegoPatchData(id, `[
+		{"op": "add", "path": "/revoked/def", "value": true},
+		{"op": "remove", "path": "/revoked/missing"}
+	]`)
+	if err == nil {
+		t.Fatal("expected error removing a missing document")
+	}
+	if e := decodeError(t, goString(err)); e.Code != codeNotFound {
+		t.Errorf("code: got %v, expected %v", e.Code, codeNotFound)
+	}
+	assertAllowed("def", true)
+
+	err = RegoPatchData(id, `[{"op": "move", "from": "/revoked/abc", "path": "/revoked/xyz"}]`)
+	if err == nil {
+		t.Fatal("expected error for unsupported operation")
+	}
+	if e := decodeError(t, goString(err)); e.Code != codeInvalidArgument {
+		t.Errorf("code: got %v, expected %v", e.Code, codeInvalidArgument)
+	}
+}
+
+func TestRegoEvalInTxn(t *testing.T) {
+	query := "data.example.allow"
+	modulename := "example.rego"
+	modulecontent := `package example
+
+	allow { not data.revoked[input.token] }`
+
+	id, err := RegoNew(query, modulename, modulecontent)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+	defer RegoDrop(id)
+
+	txn, err := RegoBeginTxn(id)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+
+	written := make(chan string)
+	go func() {
+		written <- goString(RegoSetData(id, "/revoked/abc", "true"))
+	}()
+
+	// The write waits for the transaction, so both evaluations see the data
+	// from before it.
+	for i := 0; i < 2; i++ {
+		result, err := RegoEvalInTxn(id, `{"token": "abc"}`, txn)
+		if err != nil {
+			t.Fatalf("err is not nil: %v", goString(err))
+		}
+		if !strings.Contains(goString(result), `"value":true`) {
+			t.Errorf("result: got %s, expected allow to be true", goString(result))
+		}
+	}
+
+	if err := RegoCommitTxn(txn); err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+	if err := <-written; err != "" {
+		t.Fatalf("err is not nil: %v", err)
+	}
+
+	allowed, err := RegoEvalBool(id, `{"token": "abc"}`)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+	if allowed {
+		t.Errorf("allowed: got %v, expected %v", allowed, false)
+	}
+
+	_, err = RegoEvalInTxn(id, `{}`, txn)
+	if err == nil {
+		t.Fatal("expected error for ended transaction")
+	}
+	if e := decodeError(t, goString(err)); e.Code != codeNotFound {
+		t.Errorf("code: got %v, expected %v", e.Code, codeNotFound)
+	}
+	if err := RegoAbortTxn(txn); err == nil {
+		t.Error("expected error aborting an ended transaction")
+	}
+
+	other, err := RegoNew(query, modulename, modulecontent)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+	defer RegoDrop(other)
+
+	txn, err = RegoBeginTxn(other)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+	defer RegoAbortTxn(txn)
+
+	_, err = RegoEvalInTxn(id, `{}`, txn)
+	if err == nil {
+		t.Fatal("expected error for transaction on another query's data")
+	}
+	if e := decodeError(t, goString(err)); e.Code != codeInvalidArgument {
+		t.Errorf("code: got %v, expected %v", e.Code, codeInvalidArgument)
+	}
+}
+
+func TestRegoEvalInTxn_concurrentCommit(t *testing.T) {
+	id, err := RegoNew("data.example.allow", "example.rego", `package example
+
+	allow { not data.revoked[input.token] }`)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+	defer RegoDrop(id)
+
+	txn, err := RegoBeginTxn(id)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+
+	// Each evaluation either runs in the transaction before it is committed
+	// or finds it ended; it never reads through a committed transaction.
+	type outcome struct{ result, err string }
+	outcomes := make(chan outcome)
+	for i := 0; i < 8; i++ {
+		go func() {
+			result, err := RegoEvalInTxn(id, `{"token": "abc"}`, txn)
+			outcomes <- outcome{goString(result), goString(err)}
+		}()
+	}
+
+	if err := RegoCommitTxn(txn); err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+	for i := 0; i < 8; i++ {
+		o := <-outcomes
+		if o.err != "" {
+			if e := decodeError(t, o.err); e.Code != codeNotFound {
+				t.Errorf("code: got %v, expected %v", e.Code, codeNotFound)
+			}
+		} else if !strings.Contains(o.result, `"value":true`) {
+			t.Errorf("result: got %s, expected allow to be true", o.result)
+		}
+	}
+}
+
+func TestRegoWarmup(t *testing.T) {
+	query := "data.example.allow"
+	modulename := "example.rego"
+	modulecontent := `package example
+
+	allow { regex.match("^adm", input.role) }`
+
+	id, err := RegoNew(query, modulename, modulecontent)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+
+	if err := RegoWarmup(id); err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+
+	allowed, err := RegoEvalBool(id, `{"role": "admin"}`)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+	if !allowed {
+		t.Errorf("allowed: got %v, expected %v", allowed, true)
+	}
+
+	RegoDrop(id)
+	err = RegoWarmup(id)
+	if err == nil {
+		t.Fatal("expected error for dropped id")
+	}
+	if e := decodeError(t, goString(err)); e.Code != codeNotFound {
+		t.Errorf("code: got %v, expected %v", e.Code, codeNotFound)
+	}
+}
+
+func TestRegoEvalWithInputToken(t *testing.T) {
+	modulename := "example.rego"
+	modulecontent := `package example
+
+	allow { input.role == "admin" }
+	deny { input.role == "guest" }`
+
+	allowID, err := RegoNew("data.example.allow", modulename, modulecontent)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+	defer RegoDrop(allowID)
+
+	denyID, err := RegoNew("data.example.deny", modulename, modulecontent)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+	defer RegoDrop(denyID)
+
+	token, err := RegoParseInput(`{"role": "admin"}`)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+
+	result, err := RegoEvalWithInputToken(allowID, token)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+	if !strings.Contains(goString(result), `"value":true`) {
+		t.Errorf("result: got %s, expected allow to be true", goString(result))
+	}
+
+	result, err = RegoEvalWithInputToken(denyID, token)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+	if strings.Contains(goString(result), `"value"`) {
+		t.Errorf("result: got %s, expected deny to be undefined", goString(result))
+	}
+
+	RegoDropInput(token)
+	_, err = RegoEvalWithInputToken(allowID, token)
+	if err == nil {
+		t.Fatal("expected error for dropped input")
+	}
+	if e := decodeError(t, goString(err)); e.Code != codeNotFound {
+		t.Errorf("code: got %v, expected %v", e.Code, codeNotFound)
+	}
+
+	_, err = RegoParseInput(`{"role": `)
+	if err == nil {
+		t.Fatal("expected error for invalid input")
+	}
+	if e := decodeError(t, goString(err)); e.Code != codeInvalidInput {
+		t.Errorf("code: got %v, expected %v", e.Code, codeInvalidInput)
+	}
+}
+
+func TestRegoEvalWithOverlay(t *testing.T) {
+	query := "data.example.allow"
+	modulename := "example.rego"
+	modulecontent := `package example
+
+	allow { input.user.role == "admin"; input.user.name == "alice"; input.action == "write" }`
+
+	id, err := RegoNew(query, modulename, modulecontent)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+	defer RegoDrop(id)
+
+	inputstr := `{"user": {"name": "alice", "role": "guest"}, "action": "write"}`
+
+	for _, tc := range []struct {
+		overlay  string
+		expected bool
+	}{
+		{`{}`, false},
+		{`{"user": {"role": "admin"}}`, true},
+		{`{"user": {"role": "admin"}, "action": "delete"}`, false},
+		{`{"user": null}`, false},
+	} {
+		result, err := RegoEvalWithOverlay(id, inputstr, tc.overlay)
+		if err != nil {
+			t.Fatalf("err is not nil: %v", goString(err))
+		}
+
+		allowed := strings.Contains(goString(result), `"value":true`)
+		if allowed != tc.expected {
+			t.Errorf("allowed with overlay %s: got %v, expected %v", tc.overlay, allowed, tc.expected)
+		}
+	}
+
+	_, err = RegoEvalWithOverlay(id, inputstr, `{"user": `)
+	if err == nil {
+		t.Fatal("expected error for invalid overlay")
+	}
+	if e := decodeError(t, goString(err)); e.Code != codeInvalidInput {
+		t.Errorf("code: got %v, expected %v", e.Code, codeInvalidInput)
+	}
+}
+
+func TestRegoEvalPath(t *testing.T) {
+	modulename := "example.rego"
+	modulecontent := `package example.authz
+
+	allow { input.role == "admin" }
+	deny { input.role == "guest" }`
+
+	id, err := RegoNew("data", modulename, modulecontent)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+	defer RegoDrop(id)
+
+	for _, tc := range []struct {
+		path     string
+		input    string
+		expected bool
+	}{
+		{"/example/authz/allow", `{"role": "admin"}`, true},
+		{"example/authz/deny", `{"role": "admin"}`, false},
+		{"data.example.authz.deny", `{"role": "guest"}`, true},
+		{"example.authz.allow", `{"role": "guest"}`, false},
+	} {
+		result, err := RegoEvalPath(id, tc.path, tc.input)
+		if err != nil {
+			t.Fatalf("%s: err is not nil: %v", tc.path, goString(err))
+		}
+
+		value := strings.Contains(goString(result), `"value":true`)
+		if value != tc.expected {
+			t.Errorf("%s with %s: got %s, expected %v", tc.path, tc.input, goString(result), tc.expected)
+		}
+	}
+
+	_, err = RegoEvalPath(id, "example.authz[", `{}`)
+	if err == nil {
+		t.Fatal("expected error for invalid path")
+	}
+	if e := decodeError(t, goString(err)); e.Code != codeInvalidArgument {
+		t.Errorf("code: got %v, expected %v", e.Code, codeInvalidArgument)
+	}
+}
+
+func TestRegoEvalPath_keepsOptions(t *testing.T) {
+	id, err := RegoNewWithRuntime("data.example.region", "example.rego", `package example
+
+	region = opa.runtime().region`, `{"region": "us-west"}`)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+	defer RegoDrop(id)
+
+	result, err := RegoEvalPath(id, "example/region", `{}`)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+	if !strings.Contains(goString(result), `"value":"us-west"`) {
+		t.Errorf("result: got %s, expected the runtime region", goString(result))
+	}
+}
+
+func TestRegoDataQuery(t *testing.T) {
+	modulename := "example.rego"
+	modulecontent := `package example.authz
+
+	allow { input.role == "admin" }
+	roles = ["admin", "guest"]`
+
+	id, err := RegoNew("data", modulename, modulecontent)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+	defer RegoDrop(id)
+
+	for _, tc := range []struct {
+		path     string
+		request  string
+		expected string
+	}{
+		{"example/authz/allow", `{"input": {"role": "admin"}}`, `{"result":true}`},
+		{"example/authz/allow", `{"input": {"role": "guest"}}`, `{}`},
+		{"example/authz/allow", ``, `{}`},
+		{"example/authz/roles", `{}`, `{"result":["admin","guest"]}`},
+	} {
+		result, err := RegoDataQuery(id, tc.path, tc.request)
+		if err != nil {
+			t.Fatalf("%s: err is not nil: %v", tc.path, goString(err))
+		}
+
+		if goString(result) != tc.expected {
+			t.Errorf("%s with %q: got %s, expected %s", tc.path, tc.request, goString(result), tc.expected)
+		}
+	}
+
+	_, err = RegoDataQuery(id, "example/authz/allow", `{"input": `)
+	if err == nil {
+		t.Fatal("expected error for invalid request")
+	}
+	if e := decodeError(t, goString(err)); e.Code != codeInvalidInput {
+		t.Errorf("code: got %v, expected %v", e.Code, codeInvalidInput)
+	}
+}
+
+func TestRegoEvalExpressions(t *testing.T) {
+	query := "x = data.example.roles[_]; x != input.role; count(x)"
+	modulename := "example.rego"
+	modulecontent := `package example
+
+	roles = ["admin", "ops"]`
+
+	id, err := RegoNew(query, modulename, modulecontent)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+	defer RegoDrop(id)
+
+	for _, tc := range []struct {
+		input    string
+		expected string
+	}{
+		{`{"role": "admin"}`, `[[true,true,3]]`},
+		{`{"role": "ops"}`, `[[true,true,5]]`},
+		{`{"role": "other"}`, `[[true,true,5],[true,true,3]]`},
+	} {
+		result, err := RegoEvalExpressions(id, tc.input)
+		if err != nil {
+			t.Fatalf("err is not nil: %v", goString(err))
+		}
+
+		if goString(result) != tc.expected {
+			t.Errorf("expressions for %s: got %s, expected %s", tc.input, goString(result), tc.expected)
+		}
+	}
+}
+
+func TestRegoEvalDecision(t *testing.T) {
+	query := "data.example.decision"
+	modulename := "example.rego"
+	modulecontent := `package example
+
+	decision = input.value { input.defined }`
+
+	id, err := RegoNew(query, modulename, modulecontent)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+	defer RegoDrop(id)
+
+	for _, tc := range []struct {
+		input    string
+		expected string
+	}{
+		{`{"defined": true, "value": false}`, `{"result":false}`},
+		{`{"defined": true, "value": null}`, `{"result":null}`},
+		{`{"defined": true, "value": []}`, `{"result":[]}`},
+		{`{"defined": false}`, `{}`},
+	} {
+		result, err := RegoEvalDecision(id, tc.input)
+		if err != nil {
+			t.Fatalf("err is not nil: %v", goString(err))
+		}
+
+		if goString(result) != tc.expected {
+			t.Errorf("decision for %s: got %s, expected %s", tc.input, goString(result), tc.expected)
+		}
+	}
+}
+
+func TestRegoEvalWithLimits(t *testing.T) {
+	query := "data.example.combinations"
+	modulename := "example.rego"
+	modulecontent := `package example
+
+	combinations = n { n := count({[a, b, c] | a := input.xs[_]; b := input.xs[_]; c := input.xs[_]}) }`
+
+	id, err := RegoNew(query, modulename, modulecontent)
+	if err != nil {
+		t.Errorf("err is not nil: %v", goString(err))
+	}
+
+	xs := make([]int, 50)
+	for i := range xs {
+		xs[i] = i
+	}
+	input, _ := json.Marshal(map[string][]int{"xs": xs})
+
+	_, err = RegoEvalWithLimits(id, string(input), 0, 1000)
+	if err == nil {
+		t.Fatal("expected error for exceeding the step limit")
+	}
+	if e := decodeError(t, goString(err)); e.Code != codeResourceLimit {
+		t.Errorf("code: got %v, expected %v", e.Code, codeResourceLimit)
+	}
+
+	result, err := RegoEvalWithLimits(id, string(input), 0, 0)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+	if !strings.Contains(goString(result), `"value":125000`) {
+		t.Errorf("result: got %s, expected a count of 125000", goString(result))
+	}
+}
+
+func TestRegoEvalWithTimeout(t *testing.T) {
+	query := "data.example.slow"
+	modulename := "example.rego"
+	modulecontent := `package example
+
+	slow {
+		x := input.xs[_]
+		y := input.xs[_]
+		z := input.xs[_]
+		x + y + z < 0
+	}`
+
+	id, err := RegoNew(query, modulename, modulecontent)
+	if err != nil {
+		t.Errorf("err is not nil: %v", goString(err))
+	}
+
+	xs := make([]int, 1000)
+	for i := range xs {
+		xs[i] = i
+	}
+	input, _ := json.Marshal(map[string]interface{}{"xs": xs})
+
+	_, err = RegoEvalWithTimeout(id, string(input), 10)
+	if err == nil {
+		t.Fatalf("err is nil")
+	}
+
+	if e := decodeError(t, goString(err)); e.Code != codeTimeout {
+		t.Errorf("code: got %q, expected %q", e.Code, codeTimeout)
+	}
+}
+
+func TestRegoEvalWithTimeout_disabled(t *testing.T) {
+	id, err := RegoNew("data.example.allow", "example.rego", `package example
+
+	allow { input.role == "admin" }`)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+	defer RegoDrop(id)
+
+	for _, timeoutMillis := range []int64{0, -1} {
+		result, err := RegoEvalWithTimeout(id, `{"role": "admin"}`, timeoutMillis)
+		if err != nil {
+			t.Fatalf("timeout %d: err is not nil: %v", timeoutMillis, goString(err))
+		}
+		if !strings.Contains(goString(result), `"value":true`) {
+			t.Errorf("timeout %d: got %s, expected allow to be true", timeoutMillis, goString(result))
+		}
+	}
+}
+
+func TestRegoEvalCancellable(t *testing.T) {
+	query := "data.example.slow"
+	modulename := "example.rego"
+	modulecontent := `package example
+
+	slow {
+		x := input.xs[_]
+		y := input.xs[_]
+		z := input.xs[_]
+		x + y + z < 0
+	}`
+
+	id, err := RegoNew(query, modulename, modulecontent)
+	if err != nil {
+		t.Errorf("err is not nil: %v", goString(err))
+	}
+
+	xs := make([]int, 1000)
+	for i := range xs {
+		xs[i] = i
+	}
+	input, _ := json.Marshal(map[string]interface{}{"xs": xs})
+
+	token := RegoNewCancel()
+	time.AfterFunc(10*time.Millisecond, func() { RegoCancel(token) })
+
+	_, err = RegoEvalCancellable(id, string(input), token)
+	if err == nil {
+		t.Fatalf("err is nil")
+	}
+
+	if e := decodeError(t, goString(err)); e.Code != codeCanceled {
+		t.Errorf("code: got %q, expected %q", e.Code, codeCanceled)
+	}
+
+	if len(cancels) != 0 {
+		t.Errorf("cancels length: got %d, expected %d", len(cancels), 0)
+	}
+}
+
+func TestRegoReleaseCancel(t *testing.T) {
+	token := RegoNewCancel()
+	RegoReleaseCancel(token)
+
+	if len(cancels) != 0 {
+		t.Errorf("cancels length: got %d, expected %d", len(cancels), 0)
+	}
+
+	_, err := RegoEvalCancellable(1, `{}`, token)
+	if err == nil {
+		t.Fatal("expected error for released cancel token")
+	}
+	if e := decodeError(t, goString(err)); e.Code != codeNotFound {
+		t.Errorf("code: got %v, expected %v", e.Code, codeNotFound)
+	}
+
+	RegoReleaseCancel(token)
+}
+
+func TestRegoEvalWithMetrics(t *testing.T) {
+	query := "data.example.allow"
+	modulename := "example.rego"
+	modulecontent := `package example
+
+	default allow = true`
+
+	id, err := RegoNew(query, modulename, modulecontent)
+	if err != nil {
+		t.Errorf("err is not nil: %v", goString(err))
+	}
+
+	_, m, err := RegoEvalWithMetrics(id, `{"test": 1}`)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+
+	var all map[string]interface{}
+	if err := json.Unmarshal([]byte(goString(m)), &all); err != nil {
+		t.Fatalf("could not unmarshal metrics: %v", err)
+	}
+
+	if _, ok := all["timer_rego_query_eval_ns"]; !ok {
+		t.Errorf("metrics %v do not include timer_rego_query_eval_ns", all)
+	}
+}
+
+func TestRegoEvalInstrumented(t *testing.T) {
+	query := "data.example.allow"
+	modulename := "example.rego"
+	modulecontent := `package example
+
+	allow { input.role == "admin" }`
+
+	id, err := RegoNew(query, modulename, modulecontent)
+	if err != nil {
+		t.Errorf("err is not nil: %v", goString(err))
+	}
+
+	_, m, err := RegoEvalInstrumented(id, `{"role": "admin"}`)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+
+	var all map[string]interface{}
+	if err := json.Unmarshal([]byte(goString(m)), &all); err != nil {
+		t.Fatalf("could not unmarshal metrics: %v", err)
+	}
+
+	found := false
+	for name := range all {
+		if strings.Contains(name, "eval_op_plug") {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("metrics %v do not include eval_op_plug", all)
+	}
+}
+
+func TestRegoEvalExplain_notes(t *testing.T) {
+	query := "data.example.allow"
+	modulename := "example.rego"
+	modulecontent := `package example
+
+	allow {
+		trace("checking role")
+		input.role == "admin"
+	}`
+
+	id, err := RegoNew(query, modulename, modulecontent)
+	if err != nil {
+		t.Errorf("err is not nil: %v", goString(err))
+	}
+
+	_, trace, err := RegoEvalExplain(id, `{"role": "user"}`, explainNotes)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+
+	var events []map[string]interface{}
+	if err := json.Unmarshal([]byte(goString(trace)), &events); err != nil {
+		t.Fatalf("could not unmarshal trace: %v", err)
+	}
+
+	found := false
+	for _, e := range events {
+		if e["op"] == "note" && e["message"] == "checking role" {
+			found = true
+		}
+	}
+
+	if !found {
+		t.Errorf("trace %s does not include the note", goString(trace))
+	}
+}
+
+func TestRegoEvalExplain_levels(t *testing.T) {
+	query := "data.example.allow"
+	modulename := "example.rego"
+	modulecontent := `package example
+
+	allow {
+		trace("checking role")
+		input.role == "admin"
+	}`
+
+	id, err := RegoNew(query, modulename, modulecontent)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+	defer RegoDrop(id)
+
+	for _, tc := range []struct {
+		level    int
+		expected []string
+	}{
+		{explainFull, []string{"enter", "note", "fail"}},
+		{explainFails, []string{"fail"}},
+	} {
+		_, trace, err := RegoEvalExplain(id, `{"role": "user"}`, tc.level)
+		if err != nil {
+			t.Fatalf("level %d: err is not nil: %v", tc.level, goString(err))
+		}
+
+		var events []map[string]interface{}
+		if err := json.Unmarshal([]byte(goString(trace)), &events); err != nil {
+			t.Fatalf("level %d: could not unmarshal trace: %v", tc.level, err)
+		}
+
+		ops := map[interface{}]bool{}
+		for _, e := range events {
+			ops[e["op"]] = true
+		}
+		for _, op := range tc.expected {
+			if !ops[op] {
+				t.Errorf("level %d: trace %s does not include a %s event", tc.level, goString(trace), op)
+			}
+		}
+	}
+
+	_, _, err = RegoEvalExplain(id, `{}`, 3)
+	if err == nil {
+		t.Fatal("expected error for unknown explanation level")
+	}
+	if e := decodeError(t, goString(err)); e.Code != codeInvalidArgument {
+		t.Errorf("code: got %v, expected %v", e.Code, codeInvalidArgument)
+	}
+}
+
+func TestRegoEvalWithPrints(t *testing.T) {
+	query := "data.example.allow"
+	modulename := "example.rego"
+	modulecontent := `package example
+
+	allow {
+		trace(sprintf("role is %v", [input.role]))
+		input.role == "admin"
+	}`
+
+	id, err := RegoNew(query, modulename, modulecontent)
+	if err != nil {
+		t.Errorf("err is not nil: %v", goString(err))
+	}
+
+	_, prints, err := RegoEvalWithPrints(id, `{"role": "user"}`)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+
+	var notes []note
+	if err := json.Unmarshal([]byte(goString(prints)), &notes); err != nil {
+		t.Fatalf("could not unmarshal prints: %v", err)
+	}
+
+	if len(notes) != 1 || notes[0].Message != "role is user" {
+		t.Fatalf("prints: got %s, expected one message", goString(prints))
+	}
+
+	if notes[0].Location == nil || notes[0].Location.File != modulename || notes[0].Location.Row != 4 {
+		t.Errorf("location: got %+v, expected %s:4", notes[0].Location, modulename)
+	}
+}
+
+func TestRegoPartial(t *testing.T) {
+	query := "data.example.allow == true"
+	modulename := "example.rego"
+	modulecontent := `package example
+
+	allow { input.subject.role == "admin" }
+	allow { input.resource.owner == input.subject.name }`
+
+	result, err := RegoPartial(query, modulename, modulecontent, []string{"input.resource"}, `{"subject": {"name": "alice", "role": "user"}}`)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+
+	var pq struct {
+		Queries []interface{} `json:"queries"`
+	}
+	if err := json.Unmarshal([]byte(goString(result)), &pq); err != nil {
+		t.Fatalf("could not unmarshal partial result: %v", err)
+	}
+
+	if len(pq.Queries) != 1 {
+		t.Errorf("queries: got %s, expected one residual query", goString(result))
+	}
+	_, err = RegoPartial(query, modulename, `package example
+
+	allow { undefined_function(input.subject) }`, []string{"input.resource"}, `{}`)
+	if err == nil {
+		t.Fatal("expected error for module calling an undefined function")
+	}
+	if e := decodeError(t, goString(err)); e.Code != codeCompile {
+		t.Errorf("code: got %v, expected %v", e.Code, codeCompile)
+	}
+}
+
+func TestRegoEvalWithCoverage(t *testing.T) {
+	query := "data.example.allow"
+	modulename := "example.rego"
+	modulecontent := `package example
+
+	allow { input.role == "admin" }
+
+	deny { input.role == "guest" }`
+
+	id, err := RegoNew(query, modulename, modulecontent)
+	if err != nil {
+		t.Errorf("err is not nil: %v", goString(err))
+	}
+
+	_, coverage, err := RegoEvalWithCoverage(id, `{"role": "admin"}`)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+
+	var report struct {
+		Files map[string]struct {
+			Covered    []interface{} `json:"covered"`
+			NotCovered []interface{} `json:"not_covered"`
+		} `json:"files"`
+	}
+	if err := json.Unmarshal([]byte(goString(coverage)), &report); err != nil {
+		t.Fatalf("could not unmarshal coverage: %v", err)
+	}
+
+	file, ok := report.Files[modulename]
+	if !ok {
+		t.Fatalf("coverage %s does not include %s", goString(coverage), modulename)
+	}
+
+	if len(file.Covered) == 0 || len(file.NotCovered) == 0 {
+		t.Errorf("coverage: got %s, expected covered and not covered lines", goString(coverage))
+	}
+}
+
+func TestRegoRegisterBuiltin(t *testing.T) {
+	RegoSetBuiltinCallback(echoBuiltinCallback())
+	defer RegoSetBuiltinCallback(nil)
+
+	if err := RegoRegisterBuiltin("test.echo", 1, 1); err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+	defer func() {
+		builtinMutex.Lock()
+		delete(builtins, "test.echo")
+		builtinMutex.Unlock()
+	}()
+
+	query := "data.example.allow"
+	modulename := "example.rego"
+	modulecontent := `package example
+
+	allow { test.echo(input.user) == [input.user] }`
+
+	id, err := RegoNew(query, modulename, modulecontent)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+	defer RegoDrop(id)
+
+	allowed, err := RegoEvalBool(id, `{"user": "alice"}`)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+	if !allowed {
+		t.Errorf("allowed: got %v, expected %v", allowed, true)
+	}
+}
+
+func TestRegoRegisterBuiltin_exists(t *testing.T) {
+	err := RegoRegisterBuiltin("count", 1, 1)
+	if err == nil {
+		t.Fatalf("err is nil")
+	}
+
+	if _, found := builtins["count"]; found {
+		t.Errorf("builtin count was registered")
+	}
+}
+
+func TestRegoEvalBool_largeInteger(t *testing.T) {
+	query := "data.example.allow"
+	modulename := "example.rego"
+	modulecontent := `package example
+
+	allow { input.id == 9007199254740993 }`
+
+	id, err := RegoNew(query, modulename, modulecontent)
+	if err != nil {
+		t.Errorf("err is not nil: %v", goString(err))
+	}
+
+	for _, tc := range []struct {
+		input    string
+		expected bool
+	}{
+		{`{"id": 9007199254740993}`, true},
+		{`{"id": 9007199254740992}`, false},
+	} {
+		allowed, err := RegoEvalBool(id, tc.input)
+		if err != nil {
+			t.Errorf("err is not nil: %v", goString(err))
+		}
+
+		if allowed != tc.expected {
+			t.Errorf("allowed for %s: got %v, expected %v", tc.input, allowed, tc.expected)
+		}
+	}
+}
+
+func TestRegoEval_largeInteger(t *testing.T) {
+	query := "data.example.big"
+	modulename := "example.rego"
+	modulecontent := `package example
+
+	big = 9007199254740993`
+
+	id, err := RegoNew(query, modulename, modulecontent)
+	if err != nil {
+		t.Errorf("err is not nil: %v", goString(err))
+	}
+
+	result, err := RegoEval(id, `{}`)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+
+	if !strings.Contains(goString(result), `"value":9007199254740993`) {
+		t.Errorf("result: got %s, expected the exact digits of 9007199254740993", goString(result))
+	}
+}
+
+// The embedded OPA always halts evaluation on builtin errors, reporting the
+// builtin and its location, so there is no separate strict mode to enable.
+func TestRegoEval_builtinError(t *testing.T) {
+	query := "data.example.allow"
+	modulename := "example.rego"
+	modulecontent := `package example
+
+	allow {
+		json.unmarshal(input.token).admin
+	}`
+
+	id, err := RegoNew(query, modulename, modulecontent)
+	if err != nil {
+		t.Errorf("err is not nil: %v", goString(err))
+	}
+
+	_, err = RegoEval(id, `{"token": "not json"}`)
+	if err == nil {
+		t.Fatalf("err is nil")
+	}
+
+	msg := goString(err)
+	if !strings.Contains(msg, "json.unmarshal") || !strings.Contains(msg, modulename+":4") {
+		t.Errorf("error %q does not name the builtin and its location", msg)
+	}
+}
+
+func TestRegoEval_expressionText(t *testing.T) {
+	query := "x = data.example.role; x != \"guest\""
+	modulename := "example.rego"
+	modulecontent := `package example
+
+	role = input.role`
+
+	id, err := RegoNew(query, modulename, modulecontent)
+	if err != nil {
+		t.Errorf("err is not nil: %v", goString(err))
+	}
+
+	result, err := RegoEval(id, `{"role": "admin"}`)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+
+	var results []struct {
+		Expressions []struct {
+			Text     string `json:"text"`
+			Location struct {
+				Row int `json:"row"`
+				Col int `json:"col"`
+			} `json:"location"`
+		} `json:"expressions"`
+	}
+	if err := json.Unmarshal([]byte(goString(result)), &results); err != nil {
+		t.Fatalf("could not unmarshal results: %v", err)
+	}
+
+	if len(results) != 1 || len(results[0].Expressions) != 2 {
+		t.Fatalf("results: got %s, expected one result with two expressions", goString(result))
+	}
+
+	second := results[0].Expressions[1]
+	if second.Text != `x != "guest"` || second.Location.Row != 1 || second.Location.Col != 24 {
+		t.Errorf("second expression: got %+v, expected its text and location in the query", second)
+	}
+}
+
+func TestRegoSetDecisionLogging(t *testing.T) {
+	query := "data.example.allow"
+	modulename := "example.rego"
+	modulecontent := `package example
+
+	default allow = true`
+
+	id, err := RegoNew(query, modulename, modulecontent)
+	if err != nil {
+		t.Errorf("err is not nil: %v", goString(err))
+	}
+
+	if !defaultEvaluator.registry[id].logDecisions {
+		t.Errorf("logDecisions: got %v, expected %v", false, true)
+	}
+
+	if err := RegoSetDecisionLogging(id, false); err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+
+	if defaultEvaluator.registry[id].logDecisions {
+		t.Errorf("logDecisions: got %v, expected %v", true, false)
+	}
+
+	allowed, err := RegoEvalBool(id, `{"test": 1}`)
+	if err != nil {
+		t.Errorf("err is not nil: %v", goString(err))
+	}
+
+	if !allowed {
+		t.Errorf("allowed: got %v, expected %v", allowed, true)
+	}
+}
+
+func TestRegoSetDecisionLogCallback(t *testing.T) {
+	RegoSetDecisionLogCallback(captureDecisionCallback(), 7)
+	defer RegoSetDecisionLogCallback(nil, 0)
+
+	query := "data.example.allow"
+	modulename := "example.rego"
+	modulecontent := `package example
+
+	allow { input.user == "alice" }`
+
+	id, err := RegoNew(query, modulename, modulecontent)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+	defer RegoDrop(id)
+
+	before := time.Now()
+	if _, err := RegoEval(id, `{"user": "alice"}`); err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+
+	var d struct {
+		ID        uint64      `json:"id"`
+		Evaluator uint64      `json:"evaluator"`
+		Timestamp string      `json:"timestamp"`
+		Input     interface{} `json:"input"`
+		Result    []struct {
+			Expressions []struct {
+				Value interface{} `json:"value"`
+			} `json:"expressions"`
+		} `json:"result"`
+		DurationNs int64 `json:"durationNs"`
+	}
+	if err := json.Unmarshal([]byte(lastDecision()), &d); err != nil {
+		t.Fatalf("could not unmarshal decision: %v", err)
+	}
+
+	if d.ID != id || d.Evaluator != 0 {
+		t.Errorf("decision: got %s, expected id %d in evaluator 0", lastDecision(), id)
+	}
+	if user := d.Input.(map[string]interface{})["user"]; user != "alice" {
+		t.Errorf("input: got %s, expected the evaluated input", lastDecision())
+	}
+	if len(d.Result) != 1 || d.Result[0].Expressions[0].Value != true {
+		t.Errorf("result: got %s, expected allow to be true", lastDecision())
+	}
+	if d.DurationNs <= 0 {
+		t.Errorf("durationNs: got %v, expected a positive duration", d.DurationNs)
+	}
+
+	timestamp, perr := time.Parse(time.RFC3339Nano, d.Timestamp)
+	if perr != nil {
+		t.Fatalf("could not parse timestamp: %v", perr)
+	}
+	if !strings.HasSuffix(d.Timestamp, "Z") || timestamp.Before(before.Truncate(time.Second)) || timestamp.After(time.Now()) {
+		t.Errorf("timestamp: got %v, expected the time of the evaluation in UTC", d.Timestamp)
+	}
+
+	handle := RegoNewEvaluator()
+	defer RegoDropEvaluator(handle)
+
+	evaluatorID, err := RegoEvaluatorNew(handle, query, modulename, modulecontent)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+	if _, err := RegoEvaluatorEval(handle, evaluatorID, `{"user": "bob"}`); err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+
+	if err := json.Unmarshal([]byte(lastDecision()), &d); err != nil {
+		t.Fatalf("could not unmarshal decision: %v", err)
+	}
+	if d.ID != evaluatorID || d.Evaluator != handle {
+		t.Errorf("decision: got %s, expected id %d in evaluator %d", lastDecision(), evaluatorID, handle)
+	}
+}
+
+func TestRegoEvalTraced(t *testing.T) {
+	query := "data.example.allow"
+	modulename := "example.rego"
+	modulecontent := `package example
+
+	allow { input.role == "admin" }`
+
+	id, err := RegoNew(query, modulename, modulecontent)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+	defer RegoDrop(id)
+
+	result, err := RegoEvalTraced(id, `{"role": "admin"}`, "4bf92f3577b34da6a3ce929d0e0e4736")
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+	if !strings.Contains(goString(result), `"value":true`) {
+		t.Errorf("result: got %s, expected allow to be true", goString(result))
+	}
+}
+
+func TestRegoEvalCombine(t *testing.T) {
+	modulename := "example.rego"
+	modulecontent := `package example
+
+	permit = true
+	deny = false
+	name = "not a decision"`
+
+	ids := map[string]uint64{}
+	for _, name := range []string{"permit", "deny", "undefined", "name"} {
+		id, err := RegoNew("data.example."+name, modulename, modulecontent)
+		if err != nil {
+			t.Fatalf("err is not nil: %v", goString(err))
+		}
+		defer RegoDrop(id)
+		ids[name] = id
+	}
+
+	queries := func(names ...string) []uint64 {
+		var q []uint64
+		for _, name := range names {
+			q = append(q, ids[name])
+		}
+		return q
+	}
+
+	for _, tc := range []struct {
+		queries    []uint64
+		combinator int
+		expected   bool
+	}{
+		{queries("permit", "deny"), combineDenyOverrides, false},
+		{queries("undefined", "permit"), combineDenyOverrides, true},
+		{queries("undefined"), combineDenyOverrides, false},
+		{queries("deny", "permit"), combinePermitOverrides, true},
+		{queries("deny", "undefined"), combinePermitOverrides, false},
+		{queries("undefined", "deny", "permit"), combineFirstApplicable, false},
+		{queries("undefined", "permit", "deny"), combineFirstApplicable, true},
+		{nil, combineFirstApplicable, false},
+		// Evaluation stops at the first deny, before the non-boolean query.
+		{queries("deny", "name"), combineDenyOverrides, false},
+	} {
+		decision, err := RegoEvalCombine(tc.queries, `{}`, tc.combinator)
+		if err != nil {
+			t.Fatalf("err is not nil: %v", goString(err))
+		}
+		if decision != tc.expected {
+			t.Errorf("combinator %d over %v: got %v, expected %v", tc.combinator, tc.queries, decision, tc.expected)
+		}
+	}
+
+	_, err := RegoEvalCombine(queries("permit", "name"), `{}`, combineDenyOverrides)
+	if err == nil {
+		t.Fatal("expected error for non-boolean decision")
+	}
+	if e := decodeError(t, goString(err)); e.Code != codeEval {
+		t.Errorf("code: got %v, expected %v", e.Code, codeEval)
+	}
+
+	_, err = RegoEvalCombine(queries("permit"), `{}`, 3)
+	if err == nil {
+		t.Fatal("expected error for unknown combinator")
+	}
+	if e := decodeError(t, goString(err)); e.Code != codeInvalidArgument {
+		t.Errorf("code: got %v, expected %v", e.Code, codeInvalidArgument)
+	}
+}
+
+func TestRegoEvalParsed(t *testing.T) {
+	query := "data.example.allow"
+	modulename := "example.rego"
+	modulecontent := `package example
+
+	allow { input.role == "admin"; input.id == 9007199254740993 }`
+
+	id, err := RegoNew(query, modulename, modulecontent)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+	defer RegoDrop(id)
+
+	for _, tc := range []struct {
+		input    string
+		expected bool
+	}{
+		{`{"role": "admin", "id": 9007199254740993}`, true},
+		{`{"role": "admin", "id": 9007199254740992}`, false},
+	} {
+		result, err := RegoEvalParsed(id, tc.input)
+		if err != nil {
+			t.Fatalf("%s: err is not nil: %v", tc.input, goString(err))
+		}
+		if allowed := strings.Contains(goString(result), `"value":true`); allowed != tc.expected {
+			t.Errorf("%s: got %s, expected allow to be %v", tc.input, goString(result), tc.expected)
+		}
+	}
+
+	_, err = RegoEvalParsed(id, `{"role": `)
+	if err == nil {
+		t.Fatal("expected error for invalid input")
+	}
+	if e := decodeError(t, goString(err)); e.Code != codeInvalidInput {
+		t.Errorf("code: got %v, expected %v", e.Code, codeInvalidInput)
+	}
+
+	_, err = RegoEvalParsed(1<<40, `{}`)
+	if err == nil {
+		t.Fatal("expected error for missing query")
+	}
+	if e := decodeError(t, goString(err)); e.Code != codeNotFound {
+		t.Errorf("code: got %v, expected %v", e.Code, codeNotFound)
+	}
+}
+
+func TestRegoEvalBatch(t *testing.T) {
+	query := "data.example.allow"
+	modulename := "example.rego"
+	modulecontent := `package example
+
+	default allow = false
+
+	allow { input.role == "admin" }
+
+	allow { json.unmarshal(input.token).admin }`
+
+	id, err := RegoNew(query, modulename, modulecontent)
+	if err != nil {
+		t.Errorf("err is not nil: %v", goString(err))
+	}
+
+	result, err := RegoEvalBatch(id, `[{"role": "admin"}, {"role": "user"}, {"token": "not json"}]`)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+
+	var batch []struct {
+		Result []struct {
+			Expressions []struct {
+				Value bool `json:"value"`
+			} `json:"expressions"`
+		} `json:"result"`
+		Error *cerror `json:"error"`
+	}
+	if err := json.Unmarshal([]byte(goString(result)), &batch); err != nil {
+		t.Fatalf("could not unmarshal batch: %v", err)
+	}
+
+	if len(batch) != 3 {
+		t.Fatalf("batch: got %s, expected 3 elements", goString(result))
+	}
+
+	if !batch[0].Result[0].Expressions[0].Value || batch[1].Result[0].Expressions[0].Value {
+		t.Errorf("batch: got %s, expected true then false", goString(result))
+	}
+
+	if e := batch[2].Error; e == nil || e.Code != codeEval {
+		t.Errorf("batch: got %s, expected an eval error for the last input", goString(result))
+	}
+}
+
+func TestRegoEvalMany(t *testing.T) {
+	modulename := "example.rego"
+	modulecontent := `package example
+
+	default allow = false
+
+	allow { input.role == "admin" }
+
+	quota = 10 { input.role == "admin" }`
+
+	allowID, err := RegoNew("data.example.allow", modulename, modulecontent)
+	if err != nil {
+		t.Errorf("err is not nil: %v", goString(err))
+	}
+	defer RegoDrop(allowID)
+
+	quotaID, err := RegoNew("data.example.quota", modulename, modulecontent)
+	if err != nil {
+		t.Errorf("err is not nil: %v", goString(err))
+	}
+	defer RegoDrop(quotaID)
+
+	missingID := uint64(1 << 40)
+
+	result, err := RegoEvalMany([]uint64{allowID, quotaID, missingID}, `{"role": "admin"}`)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+
+	var many map[string]struct {
+		Result []struct {
+			Expressions []struct {
+				Value interface{} `json:"value"`
+			} `json:"expressions"`
+		} `json:"result"`
+		Error *cerror `json:"error"`
+	}
+	if err := json.Unmarshal([]byte(goString(result)), &many); err != nil {
+		t.Fatalf("could not unmarshal results: %v", err)
+	}
+
+	if v := many[fmt.Sprint(allowID)].Result[0].Expressions[0].Value; v != true {
+		t.Errorf("allow: got %v, expected %v", v, true)
+	}
+
+	if v := many[fmt.Sprint(quotaID)].Result[0].Expressions[0].Value; v != 10.0 {
+		t.Errorf("quota: got %v, expected %v", v, 10)
+	}
+
+	if e := many[fmt.Sprint(missingID)].Error; e == nil || e.Code != codeNotFound {
+		t.Errorf("results: got %s, expected a not found error for the missing id", goString(result))
+	}
+}
+
+// Calls from Go do not cross the cgo boundary, so these benchmarks understate
+// the difference seen by C callers; they show the per-call overhead that
+// batching removes on the Go side.
+const benchmarkBatchSize = 100
+
+func benchmarkQuery(b *testing.B) (uint64, []string) {
+	modulecontent := `package example
+
+	default allow = false
+
+	allow { input.role == "admin" }`
+
+	id, err := RegoNew("data.example.allow", "example.rego", modulecontent)
+	if err != nil {
+		b.Fatalf("err is not nil: %v", goString(err))
+	}
+
+	inputs := make([]string, benchmarkBatchSize)
+	for i := range inputs {
+		inputs[i] = fmt.Sprintf(`{"role": "user-%d"}`, i)
+	}
+
+	return id, inputs
+}
+
+func BenchmarkRegoEval_individual(b *testing.B) {
+	id, inputs := benchmarkQuery(b)
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for _, input := range inputs {
+			result, err := RegoEval(id, input)
+			if err != nil {
+				b.Fatalf("err is not nil: %v", goString(err))
+			}
+			Free(unsafe.Pointer(result))
+		}
+	}
+}
+
+func BenchmarkRegoEvalBatch(b *testing.B) {
+	id, inputs := benchmarkQuery(b)
+	batch := "[" + strings.Join(inputs, ",") + "]"
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		result, err := RegoEvalBatch(id, batch)
+		if err != nil {
+			b.Fatalf("err is not nil: %v", goString(err))
+		}
+		Free(unsafe.Pointer(result))
+	}
+}
+
+func benchmarkInput() string {
+	xs := make([]string, 1000)
+	for i := range xs {
+		xs[i] = fmt.Sprintf("item-%d", i)
+	}
+	input, _ := json.Marshal(map[string]interface{}{"xs": xs})
+	return string(input)
+}
+
+func BenchmarkParseInput(b *testing.B) {
+	inputstr := benchmarkInput()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if _, err := parseInput(inputstr); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkParseInput_copied decodes the way parseInput did before it read
+// the string in place, copying it to a byte slice first, for comparison.
+func BenchmarkParseInput_copied(b *testing.B) {
+	inputstr := benchmarkInput()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		decoder := json.NewDecoder(bytes.NewReader([]byte(inputstr)))
+		decoder.UseNumber()
+
+		var input interface{}
+		if err := decoder.Decode(&input); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestRegoEvalRuleValue(t *testing.T) {
+	query := "data.example.decision"
+	modulename := "example.rego"
+	modulecontent := `package example
+
+	decision = {"allow": true, "reason": "admin"} { input.role == "admin" }`
+
+	id, err := RegoNew(query, modulename, modulecontent)
+	if err != nil {
+		t.Errorf("err is not nil: %v", goString(err))
+	}
+
+	for _, tc := range []struct {
+		input    string
+		expected string
+	}{
+		{`{"role": "admin"}`, `{"allow":true,"reason":"admin"}`},
+		{`{"role": "user"}`, `null`},
+	} {
+		value, err := RegoEvalRuleValue(id, tc.input)
+		if err != nil {
+			t.Fatalf("err is not nil: %v", goString(err))
+		}
+
+		if goString(value) != tc.expected {
+			t.Errorf("value for %s: got %s, expected %s", tc.input, goString(value), tc.expected)
+		}
+	}
+}
+
+func TestRegoEvalObject(t *testing.T) {
+	modulename := "example.rego"
+	modulecontent := `package example
+
+	decision = {"allow": true, "reason": "admin"} { input.role == "admin" }
+
+	role = input.role`
+
+	id, err := RegoNew("data.example.decision", modulename, modulecontent)
+	if err != nil {
+		t.Errorf("err is not nil: %v", goString(err))
+	}
+
+	for _, tc := range []struct {
+		input    string
+		expected string
+	}{
+		{`{"role": "admin"}`, `{"allow":true,"reason":"admin"}`},
+		{`{"role": "user"}`, `null`},
+	} {
+		value, err := RegoEvalObject(id, tc.input)
+		if err != nil {
+			t.Fatalf("err is not nil: %v", goString(err))
+		}
+
+		if goString(value) != tc.expected {
+			t.Errorf("value for %s: got %s, expected %s", tc.input, goString(value), tc.expected)
+		}
+	}
+
+	id, err = RegoNew("data.example.role", modulename, modulecontent)
+	if err != nil {
+		t.Errorf("err is not nil: %v", goString(err))
+	}
+
+	_, err = RegoEvalObject(id, `{"role": "admin"}`)
+	if err == nil {
+		t.Fatalf("err is nil")
+	}
+	if e := decodeError(t, goString(err)); e.Code != codeEval {
+		t.Errorf("code: got %v, expected %v", e.Code, codeEval)
+	}
+}
+
+func TestRegoEvalPage(t *testing.T) {
+	query := "x = input.numbers[_]"
+	modulename := "example.rego"
+	modulecontent := `package example`
+
+	id, err := RegoNew(query, modulename, modulecontent)
+	if err != nil {
+		t.Errorf("err is not nil: %v", goString(err))
+	}
+
+	input := `{"numbers": [1, 2, 3, 4, 5]}`
+
+	var all []string
+	offset := int64(0)
+	for offset >= 0 {
+		page, next, err := RegoEvalPage(id, input, offset, 2)
+		if err != nil {
+			t.Fatalf("err is not nil: %v", goString(err))
+		}
+
+		var results []struct {
+			Bindings map[string]interface{} `json:"bindings"`
+		}
+		if err := json.Unmarshal([]byte(goString(page)), &results); err != nil {
+			t.Fatalf("could not unmarshal page: %v", err)
+		}
+		if len(results) > 2 {
+			t.Fatalf("page: got %d results, expected at most 2", len(results))
+		}
+		for _, r := range results {
+			all = append(all, fmt.Sprint(r.Bindings["x"]))
+		}
+
+		offset = int64(next)
+	}
+
+	if actual := strings.Join(all, ","); actual != "1,2,3,4,5" {
+		t.Errorf("results: got %v, expected %v", actual, "1,2,3,4,5")
+	}
+}
+
+func TestRegoEvalFirstResult(t *testing.T) {
+	query := "x = data.example.role"
+	modulename := "example.rego"
+	modulecontent := `package example
+
+	role = input.role`
+
+	id, err := RegoNew(query, modulename, modulecontent)
+	if err != nil {
+		t.Errorf("err is not nil: %v", goString(err))
+	}
+
+	for _, tc := range []struct {
+		input    string
+		expected string
+	}{
+		{`{"role": "admin"}`, `{"expressions":[{"value":true,"text":"x = data.example.role","location":{"row":1,"col":1}}],"bindings":{"x":"admin"}}`},
+		{`{}`, `null`},
+	} {
+		result, err := RegoEvalFirstResult(id, tc.input)
+		if err != nil {
+			t.Fatalf("err is not nil: %v", goString(err))
+		}
+
+		if goString(result) != tc.expected {
+			t.Errorf("result for %s: got %s, expected %s", tc.input, goString(result), tc.expected)
+		}
+	}
+}
+
+func TestRegoEvalBindings(t *testing.T) {
+	query := "x = data.example.servers[_]; x.region == input.region"
+	modulename := "example.rego"
+	modulecontent := `package example
+
+	servers = [
+		{"name": "a", "region": "us"},
+		{"name": "b", "region": "eu"},
+		{"name": "c", "region": "us"},
+	]`
+
+	id, err := RegoNew(query, modulename, modulecontent)
+	if err != nil {
+		t.Errorf("err is not nil: %v", goString(err))
+	}
+
+	result, err := RegoEvalBindings(id, `{"region": "us"}`)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+
+	var bindings []struct {
+		X struct {
+			Name string `json:"name"`
+		} `json:"x"`
+	}
+	if err := json.Unmarshal([]byte(goString(result)), &bindings); err != nil {
+		t.Fatalf("could not unmarshal bindings: %v", err)
+	}
+
+	if len(bindings) != 2 || bindings[0].X.Name != "a" || bindings[1].X.Name != "c" {
+		t.Errorf("bindings: got %s, expected servers a and c", goString(result))
+	}
+}
+
+func TestRegoCheck(t *testing.T) {
+	modulename := "example.rego"
+
+	if err := RegoCheck(modulename, `package example
+
+	allow { input.role == "admin" }`); err != nil {
+		t.Errorf("err is not nil: %v", goString(err))
+	}
+
+	err := RegoCheck(modulename, `package example
+
+	allow { x }`)
+	if err == nil {
+		t.Fatalf("err is nil")
+	}
+
+	e := decodeError(t, goString(err))
+	if e.Code != codeCompile || len(e.Errors) != 1 {
+		t.Fatalf("error: got %s, expected a single compile error", goString(err))
+	}
+
+	if e.Errors[0].Code != "rego_unsafe_var_error" || e.Errors[0].Location.File != modulename || e.Errors[0].Location.Row != 3 {
+		t.Errorf("errors: got %s, expected an unsafe var error at %s:3", goString(err), modulename)
+	}
+}
+
+func TestRegoCheck_registeredBuiltin(t *testing.T) {
+	if err := RegoRegisterBuiltin("test.lookup", 1, 1); err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+	defer func() {
+		builtinMutex.Lock()
+		delete(builtins, "test.lookup")
+		builtinMutex.Unlock()
+	}()
+
+	if err := RegoCheck("example.rego", `package example
+
+	allow { test.lookup(input.user) }`); err != nil {
+		t.Errorf("err is not nil: %v", goString(err))
+	}
+}
+
+func TestRegoCompileQuery(t *testing.T) {
+	result, err := RegoCompileQuery(`x := input.a; x > 1`)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+
+	var compiled struct {
+		Query string `json:"query"`
+	}
+	if err := json.Unmarshal([]byte(goString(result)), &compiled); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(compiled.Query, "input.a") {
+		t.Errorf("query: got %q, expected it to reference input.a", compiled.Query)
+	}
+
+	for query, code := range map[string]string{
+		`y > 1`:              "rego_unsafe_var_error",
+		`test.compiled(1)`:   "rego_type_error",
+		`x := input.a; x = `: "rego_parse_error",
+	} {
+		_, err := RegoCompileQuery(query)
+		if err == nil {
+			t.Errorf("%s: expected error", query)
+			continue
+		}
+
+		e := decodeError(t, goString(err))
+		if e.Code != codeCompile || len(e.Errors) == 0 || e.Errors[0].Code != code {
+			t.Errorf("%s: got %s, expected a %s", query, goString(err), code)
+		}
+	}
+
+	if err := RegoRegisterBuiltin("test.compiled", 1, 1); err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+	defer func() {
+		builtinMutex.Lock()
+		delete(builtins, "test.compiled")
+		builtinMutex.Unlock()
+	}()
+
+	if _, err := RegoCompileQuery(`test.compiled(1)`); err != nil {
+		t.Errorf("err is not nil for registered builtin: %v", goString(err))
+	}
+}
+
+func TestRegoRules(t *testing.T) {
+	modulename := "example.rego"
+	modulecontent := `package example.authz
+
+	default allow = false
+	allow { input.role == "admin" }
+	deny[msg] { msg := "denied" }
+	roles[name] = role { role := input.roles[name] }
+	is_admin(user) { user.role == "admin" }`
+
+	result, err := RegoRules(modulename, modulecontent)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+
+	var rules []struct {
+		Path string `json:"path"`
+		Kind string `json:"kind"`
+	}
+	if err := json.Unmarshal([]byte(goString(result)), &rules); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []struct {
+		Path string `json:"path"`
+		Kind string `json:"kind"`
+	}{
+		{"data.example.authz.allow", "complete"},
+		{"data.example.authz.deny", "partial_set"},
+		{"data.example.authz.roles", "partial_object"},
+		{"data.example.authz.is_admin", "function"},
+	}
+	if fmt.Sprint(rules) != fmt.Sprint(expected) {
+		t.Errorf("rules: got %v, expected %v", rules, expected)
+	}
+
+	_, err = RegoRules(modulename, `package`)
+	if err == nil {
+		t.Fatal("expected error for invalid module")
+	}
+	if e := decodeError(t, goString(err)); e.Code != codeCompile {
+		t.Errorf("code: got %v, expected %v", e.Code, codeCompile)
+	}
+}
+
+func TestRegoQueryData(t *testing.T) {
+	result, err := RegoQueryData(
+		`names := [x.name | x := data.items[_]; x.active; x.owner == input.owner]`,
+		`{"items": [{"name": "a", "active": true, "owner": "alice"}, {"name": "b", "active": false, "owner": "alice"}, {"name": "c", "active": true, "owner": "bob"}]}`,
+		`{"owner": "alice"}`,
+	)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+
+	var results []struct {
+		Bindings struct {
+			Names []string `json:"names"`
+		} `json:"bindings"`
+	}
+	if err := json.Unmarshal([]byte(goString(result)), &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || fmt.Sprint(results[0].Bindings.Names) != "[a]" {
+		t.Errorf("result: got %s, expected names [a]", goString(result))
+	}
+
+	for _, tc := range []struct {
+		query string
+		data  string
+		code  string
+	}{
+		{`x > 1`, `{}`, codeCompile},
+		{`data.items`, `[1, 2]`, codeInvalidInput},
+	} {
+		_, err := RegoQueryData(tc.query, tc.data, `{}`)
+		if err == nil {
+			t.Errorf("%s: expected error", tc.query)
+			continue
+		}
+		if e := decodeError(t, goString(err)); e.Code != tc.code {
+			t.Errorf("%s: code: got %v, expected %v", tc.query, e.Code, tc.code)
+		}
+	}
+}
+
+func TestRegoCheckRelaxed(t *testing.T) {
+	modulename := "example.rego"
+	modulecontent := `package example
+
+	allow { not strings.any_prefix_match(input.path, "/admin") }
+	allow { x := future.hash(input.token, "sha3"); is_known(x) }
+	is_known(x) { x == "abc" }`
+
+	if err := RegoCheck(modulename, modulecontent); err == nil {
+		t.Fatal("expected RegoCheck to reject unknown builtins")
+	}
+
+	warnings, err := RegoCheckRelaxed(modulename, modulecontent)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+
+	expected := `["future.hash","strings.any_prefix_match"]`
+	if goString(warnings) != expected {
+		t.Errorf("warnings: got %s, expected %s", goString(warnings), expected)
+	}
+
+	_, err = RegoCheckRelaxed(modulename, `package example
+
+	allow { future.hash(x) }`)
+	if err == nil {
+		t.Fatal("expected error for unsafe variable")
+	}
+	if e := decodeError(t, goString(err)); e.Code != codeCompile {
+		t.Errorf("code: got %v, expected %v", e.Code, codeCompile)
+	}
+}
+
+func TestRegoNewRelaxed(t *testing.T) {
+	query := "data.example.allow"
+	modulename := "example.rego"
+	modulecontent := `package example
+
+	default allow = false
+	allow { not strings.any_prefix_match(input.path, "/admin") }`
+
+	id, warnings, err := RegoNewRelaxed(query, modulename, modulecontent)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+	defer RegoDrop(id)
+
+	if goString(warnings) != `["strings.any_prefix_match"]` {
+		t.Errorf("warnings: got %s, expected the unknown builtin", goString(warnings))
+	}
+
+	// The unknown builtin is undefined, so its negation holds.
+	allowed, err := RegoEvalBool(id, `{"path": "/admin/users"}`)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+	if !allowed {
+		t.Errorf("allowed: got %v, expected %v", allowed, true)
+	}
+}
+
+func TestRegoCheckPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "opa-check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"a/a.rego": `package a
+
+		allow { x }`,
+		"b/b.rego": `package b
+
+		deny { y }`,
+		"scratch/broken.rego": `package`,
+	}
+
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cerr := RegoCheckPath([]string{dir}, []string{"scratch"})
+	if cerr == nil {
+		t.Fatalf("err is nil")
+	}
+
+	e := decodeError(t, goString(cerr))
+	if e.Code != codeCompile || len(e.Errors) != 2 {
+		t.Fatalf("error: got %s, expected two compile errors", goString(cerr))
+	}
+
+	reported := map[string]bool{}
+	for _, err := range e.Errors {
+		reported[filepath.Base(err.Location.File)] = true
+	}
+	if !reported["a.rego"] || !reported["b.rego"] {
+		t.Errorf("errors: got %s, expected one in each of a.rego and b.rego", goString(cerr))
+	}
+}
+
+func TestRegoCheckPath_registeredBuiltin(t *testing.T) {
+	if err := RegoRegisterBuiltin("test.lookup", 1, 1); err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+	defer func() {
+		builtinMutex.Lock()
+		delete(builtins, "test.lookup")
+		builtinMutex.Unlock()
+	}()
+
+	dir, err := ioutil.TempDir("", "opa-check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "example.rego"), []byte(`package example
+
+	allow { test.lookup(input.user) }`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cerr := RegoCheckPath([]string{dir}, nil); cerr != nil {
+		t.Errorf("err is not nil: %v", goString(cerr))
+	}
+}
+
+func TestRegoParseModule(t *testing.T) {
+	modulename := "example.rego"
+
+	result, err := RegoParseModule(modulename, `package example
+
+	allow { input.role == "admin" }`)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+
+	var module struct {
+		Rules []struct {
+			Head struct {
+				Name string `json:"name"`
+			} `json:"head"`
+		} `json:"rules"`
+	}
+	if err := json.Unmarshal([]byte(goString(result)), &module); err != nil {
+		t.Fatalf("could not unmarshal module: %v", err)
+	}
+
+	if len(module.Rules) != 1 || module.Rules[0].Head.Name != "allow" {
+		t.Errorf("module: got %s, expected a single rule named allow", goString(result))
+	}
+
+	_, err = RegoParseModule(modulename, `package example
+
+	allow {`)
+	if err == nil {
+		t.Fatalf("err is nil")
+	}
+
+	e := decodeError(t, goString(err))
+	if e.Code != codeCompile || len(e.Errors) == 0 || e.Errors[0].Code != "rego_parse_error" {
+		t.Errorf("error: got %s, expected a parse error", goString(err))
+	}
+}
+
+func TestRegoFormat(t *testing.T) {
+	modulename := "example.rego"
+
+	result, err := RegoFormat(modulename, "package example\nallow {input.role==\"admin\"}")
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+
+	expected := "package example\n\nallow {\n\tinput.role == \"admin\"\n}\n"
+	if actual := goString(result); actual != expected {
+		t.Errorf("formatted: got %q, expected %q", actual, expected)
+	}
+
+	_, err = RegoFormat(modulename, "package example\nallow {")
+	if err == nil {
+		t.Fatalf("err is nil")
+	}
+	if e := decodeError(t, goString(err)); e.Code != codeCompile {
+		t.Errorf("code: got %v, expected %v", e.Code, codeCompile)
+	}
+}
+
+func TestRegoEval_errorCodes(t *testing.T) {
+	query := "data.example.allow"
+	modulename := "example.rego"
+	modulecontent := `package example
+
+	default allow = false`
+
+	_, err := RegoNew(query, modulename, `package example
+
+	allow { x }`)
+	if e := decodeError(t, goString(err)); e.Code != codeCompile {
+		t.Errorf("code: got %q, expected %q", e.Code, codeCompile)
+	}
+
+	id, err := RegoNew(query, modulename, modulecontent)
+	if err != nil {
+		t.Errorf("err is not nil: %v", goString(err))
+	}
+
+	_, err = RegoEval(id, `{"test": `)
+	if e := decodeError(t, goString(err)); e.Code != codeInvalidInput {
+		t.Errorf("code: got %q, expected %q", e.Code, codeInvalidInput)
+	}
+
+	RegoDrop(id)
+
+	_, err = RegoEval(id, `{"test": 1}`)
+	if e := decodeError(t, goString(err)); e.Code != codeNotFound {
+		t.Errorf("code: got %q, expected %q", e.Code, codeNotFound)
+	}
+}
+
+func TestRegoNew_errorLocations(t *testing.T) {
+	query := "data.example.allow"
+	names := []string{"example.rego", "broken.rego"}
+	contents := []string{
+		`package example
+
+		default allow = false`,
+		`package broken
+
+		deny {`,
+	}
+
+	_, err := RegoNewModules(query, names, contents)
+	if err == nil {
+		t.Fatalf("err is nil")
+	}
+
+	e := decodeError(t, goString(err))
+	if e.Code != codeCompile || len(e.Errors) == 0 {
+		t.Fatalf("error: got %s, expected compile errors", goString(err))
+	}
+
+	for _, astErr := range e.Errors {
+		if astErr.Location == nil || astErr.Location.File != "broken.rego" || astErr.Location.Row != 3 {
+			t.Errorf("location: got %+v, expected broken.rego:3", astErr.Location)
+		}
+	}
+}
+
+func TestModuleNamesInErrors(t *testing.T) {
+	query := "data.example.allow"
+	modulename := "policies/authz/example.rego"
+	broken := `package example
+
+	allow { x }`
+
+	newID := func() uint64 {
+		id, err := RegoNew(query, modulename, `package example`)
+		if err != nil {
+			t.Fatalf("err is not nil: %v", goString(err))
+		}
+		return id
+	}
+
+	for name, f := range map[string]func() string{
+		"RegoNew": func() string {
+			_, err := RegoNew(query, modulename, broken)
+			return goString(err)
+		},
+		"RegoNewModules": func() string {
+			_, err := RegoNewModules(query, []string{modulename}, []string{broken})
+			return goString(err)
+		},
+		"RegoNewWithData": func() string {
+			_, err := RegoNewWithData(query, modulename, broken, `{}`)
+			return goString(err)
+		},
+		"RegoNewWithRuntime": func() string {
+			_, err := RegoNewWithRuntime(query, modulename, broken, `{}`)
+			return goString(err)
+		},
+		"RegoNewRestricted": func() string {
+			_, err := RegoNewRestricted(query, modulename, broken, `[]`)
+			return goString(err)
+		},
+		"RegoNewMultiQuery": func() string {
+			ids := make([]uint64, 1)
+			return goString(RegoNewMultiQuery([]string{query}, []string{modulename}, []string{broken}, ids))
+		},
+		"RegoReplaceModule": func() string {
+			id := newID()
+			defer RegoDrop(id)
+			return goString(RegoReplaceModule(id, query, modulename, broken))
+		},
+		"RegoEvaluatorNew": func() string {
+			_, err := RegoEvaluatorNew(0, query, modulename, broken)
+			return goString(err)
+		},
+		"RegoCheck": func() string {
+			return goString(RegoCheck(modulename, broken))
+		},
+		"WasmBuildFromModules": func() string {
+			_, _, err := WasmBuildFromModules(query, []string{modulename}, []string{broken})
+			return goString(err)
+		},
+	} {
+		msg := f()
+		if msg == "" {
+			t.Errorf("%s: err is nil", name)
+			continue
+		}
+
+		e := decodeError(t, msg)
+		if len(e.Errors) == 0 {
+			t.Errorf("%s: got %s, expected a list of errors", name, msg)
+			continue
+		}
+
+		for _, astErr := range e.Errors {
+			if astErr.Location == nil || astErr.Location.File != modulename {
+				t.Errorf("%s: location: got %+v, expected %s", name, astErr.Location, modulename)
+			}
+		}
+	}
+
+	id, err := RegoNew(query, modulename, `package example
+
+	allow = true { true }
+	allow = false { true }`)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+	defer RegoDrop(id)
+
+	_, err = RegoEval(id, `{}`)
+	if err == nil {
+		t.Fatalf("err is nil")
+	}
+
+	if e := decodeError(t, goString(err)); e.Location == nil || e.Location.File != modulename {
+		t.Errorf("eval error location: got %+v, expected %s", e.Location, modulename)
+	}
+}
+
+func TestOpaVersion(t *testing.T) {
+	v := goString(OpaVersion())
+
+	var info map[string]string
+	if err := json.Unmarshal([]byte(goString(OpaVersionInfo())), &info); err != nil {
+		t.Fatalf("could not unmarshal version info: %v", err)
+	}
+
+	if v == "" || info["version"] != v {
+		t.Errorf("version: got %q and %q, expected the same non-empty version", v, info["version"])
+	}
+
+	for _, key := range []string{"version", "vcs", "timestamp", "go_version"} {
+		if _, ok := info[key]; !ok {
+			t.Errorf("version info: got %v, expected key %q", info, key)
+		}
+	}
+}
+
+func TestRegoCapabilities(t *testing.T) {
+	result, err := RegoCapabilities()
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+
+	var caps capabilities
+	if err := json.Unmarshal([]byte(goString(result)), &caps); err != nil {
+		t.Fatalf("could not unmarshal capabilities: %v", err)
+	}
+
+	found := false
+	for _, b := range caps.Builtins {
+		if b.Name == "http.send" {
+			found = true
+		}
+	}
+
+	if !found {
+		t.Errorf("capabilities do not include http.send")
+	}
+}
+
+func TestWasmBuildFromModules(t *testing.T) {
+	names := []string{"example.rego"}
+	contents := []string{`package example
+
+	default allow = false`}
+
+	ptr, n, err := WasmBuildFromModules("data.example.allow", names, contents)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+	defer Free(ptr)
+
+	if bytes := goBytes(ptr, n); n < 4 || string(bytes[:4]) != "\x00asm" {
+		t.Errorf("module does not start with the wasm magic number")
+	}
+}
+
+func TestWasmBuildWithCapabilities(t *testing.T) {
+	dir, err := ioutil.TempDir("", "opa-wasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	modulecontent := `package example
+
+	allow {
+		http.send({"method": "get", "url": "http://localhost"}).status_code == 200
+	}`
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "policy.rego"), []byte(modulecontent), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	caps := `{"builtins": [{"name": "eq"}, {"name": "equal"}]}`
+
+	_, _, cerr := WasmBuildWithCapabilities("data.example.allow", []string{dir}, nil, nil, caps)
+	if cerr == nil {
+		t.Fatal("expected error for disallowed builtin")
+	}
+
+	e := decodeError(t, goString(cerr))
+	if e.Code != codeCompile {
+		t.Errorf("code: got %v, expected %v", e.Code, codeCompile)
+	}
+	if !strings.Contains(e.Message, "http.send") {
+		t.Errorf("message: got %v, expected it to name http.send", e.Message)
+	}
+
+	_, _, cerr = WasmBuildWithCapabilities("data.example.allow", []string{dir}, nil, nil, "{")
+	if cerr == nil {
+		t.Fatal("expected error for invalid capabilities")
+	}
+	if e := decodeError(t, goString(cerr)); e.Code != codeInvalidArgument {
+		t.Errorf("code: got %v, expected %v", e.Code, codeInvalidArgument)
+	}
+}
+
+func TestWasmBuildOptimized(t *testing.T) {
+	dir, err := ioutil.TempDir("", "opa-wasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	modulecontent := `package example
+
+	default allow = false
+
+	allow {
+		input.user == "admin"
+	}`
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "policy.rego"), []byte(modulecontent), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, optimize := range []int{0, 1, 2} {
+		ptr, n, cerr := WasmBuildOptimized("data.example.allow", []string{dir}, nil, nil, optimize)
+		if cerr != nil {
+			t.Fatalf("O%d: err is not nil: %v", optimize, goString(cerr))
+		}
+		if bytes := goBytes(ptr, n); n < 4 || string(bytes[:4]) != "\x00asm" {
+			t.Errorf("O%d: module does not start with the wasm magic number", optimize)
+		}
+		Free(ptr)
+	}
+
+	_, _, cerr := WasmBuildOptimized("data.example.allow", []string{dir}, nil, nil, -1)
+	if cerr == nil {
+		t.Fatal("expected error for negative optimization level")
+	}
+	if e := decodeError(t, goString(cerr)); e.Code != codeInvalidArgument {
+		t.Errorf("code: got %v, expected %v", e.Code, codeInvalidArgument)
+	}
+}
+
+func TestWasmBuildBundle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "opa-wasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"policy.rego": `package example
+
+		allow {
+			input.user == data.example.admin
+		}`,
+		"data.json": `{"example": {"admin": "alice"}}`,
+	}
+
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ptr, n, cerr := WasmBuildBundle("data.example.allow", []string{dir}, nil, nil)
+	if cerr != nil {
+		t.Fatalf("err is not nil: %v", goString(cerr))
+	}
+	defer Free(ptr)
+
+	gr, err := gzip.NewReader(bytes.NewReader(goBytes(ptr, n)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := map[string]bool{}
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		found[strings.TrimPrefix(hdr.Name, "/")] = true
+	}
+
+	for _, name := range []string{"policy.wasm", "data.json"} {
+		if !found[name] {
+			t.Errorf("bundle is missing %v", name)
+		}
+	}
+}
+
+func TestFreeCString(t *testing.T) {
+	_, err := RegoNew("data.example.allow", "example.rego", "package")
+	if err == nil {
+		t.Fatal("expected error for invalid module")
+	}
+
+	FreeCString(err)
+	FreeCString(nil)
+}
+
+func TestFreeResultAndError(t *testing.T) {
+	id, cerr := RegoNew("data.example.allow", "example.rego", `package example
+
+	allow = true`)
+	if cerr != nil {
+		t.Fatalf("err is not nil: %v", goString(cerr))
+	}
+	defer RegoDrop(id)
+
+	seen := map[unsafe.Pointer]string{}
+
+	// check asserts that exactly the expected one of result and err is set,
+	// and that neither was handed out by an earlier call. The pointers are
+	// only freed at the end, so malloc cannot reuse them in the meantime.
+	check := func(name string, result, err unsafe.Pointer, wantErr bool) {
+		t.Helper()
+
+		if (err != nil) != wantErr || (result != nil) == wantErr {
+			t.Errorf("%s: got result %v and err %v, expected exactly one to be set", name, result, err)
+		}
+
+		for _, ptr := range []unsafe.Pointer{result, err} {
+			if ptr == nil {
+				continue
+			}
+			if previous, found := seen[ptr]; found {
+				t.Errorf("%s: returned the same pointer as %s", name, previous)
+			}
+			seen[ptr] = name
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		result, err := RegoEval(id, `{}`)
+		check("RegoEval", unsafe.Pointer(result), unsafe.Pointer(err), false)
+
+		result, err = RegoEval(id, `{`)
+		check("RegoEval invalid input", unsafe.Pointer(result), unsafe.Pointer(err), true)
+
+		result, err = RegoEval(0, `{}`)
+		check("RegoEval unknown id", unsafe.Pointer(result), unsafe.Pointer(err), true)
+
+		result, err = RegoEvalDecision(id, `{}`)
+		check("RegoEvalDecision", unsafe.Pointer(result), unsafe.Pointer(err), false)
+
+		result, err = RegoParseModule("example.rego", "package example")
+		check("RegoParseModule", unsafe.Pointer(result), unsafe.Pointer(err), false)
+
+		result, err = RegoParseModule("example.rego", "package")
+		check("RegoParseModule invalid module", unsafe.Pointer(result), unsafe.Pointer(err), true)
+
+		_, err = RegoNew("data.example.allow", "example.rego", "package")
+		check("RegoNew invalid module", nil, unsafe.Pointer(err), true)
+	}
+
+	for ptr := range seen {
+		Free(ptr)
+	}
+}
+
+// rss returns the resident set size of the test process in bytes.
+func rss(t *testing.T) int64 {
+	t.Helper()
+
+	statm, err := ioutil.ReadFile("/proc/self/statm")
+	if err != nil {
+		t.Skipf("cannot read resident set size: %v", err)
+	}
+
+	var size, resident int64
+	if _, err := fmt.Sscan(string(statm), &size, &resident); err != nil {
+		t.Fatalf("could not parse statm: %v", err)
+	}
+
+	return resident * int64(os.Getpagesize())
+}
+
+// TestRegoNew_errorsDoNotLeak runs hundreds of thousands of failing RegoNew
+// calls, so it only runs when OPA_LEAK_TEST is set.
+func TestRegoNew_errorsDoNotLeak(t *testing.T) {
+	if os.Getenv("OPA_LEAK_TEST") == "" || testing.Short() {
+		t.Skip("skipping leak test; set OPA_LEAK_TEST to run it")
+	}
+
+	fail := func(n int) {
+		for i := 0; i < n; i++ {
+			_, err := RegoNew("data.example.allow", "example.rego", "package")
+			if err == nil {
+				t.Fatal("expected error for invalid module")
+			}
+			FreeCString(err)
+		}
+	}
+
+	// Warm up so the Go heap reaches a steady state before measuring.
+	fail(10000)
+	before := rss(t)
+
+	// Each error string is a few hundred bytes, so leaking them all would
+	// grow the process by tens of megabytes.
+	fail(200000)
+	after := rss(t)
+
+	if growth := after - before; growth > 16<<20 {
+		t.Errorf("rss grew by %d bytes after freeing every error", growth)
+	}
+}
+
+func TestRegoReplaceModule(t *testing.T) {
+	query := "data.example.allow"
+	modulename := "example.rego"
+	modulecontent := `package example
+
+	default allow = false`
+
+	id, err := RegoNew(query, modulename, modulecontent)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+	defer RegoDrop(id)
+
+	if err := RegoReplaceModule(id, query, modulename, `package example
+
+	default allow = true`); err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+
+	allowed, err := RegoEvalBool(id, `{}`)
+	if err != nil {
+		t.Errorf("err is not nil: %v", goString(err))
+	}
+	if !allowed {
+		t.Errorf("allowed: got %v, expected %v", allowed, true)
+	}
+
+	err = RegoReplaceModule(id, query, modulename, "package")
+	if err == nil {
+		t.Fatal("expected error for invalid module")
+	}
+	if e := decodeError(t, goString(err)); e.Code != codeCompile {
+		t.Errorf("code: got %v, expected %v", e.Code, codeCompile)
+	}
+
+	allowed, err = RegoEvalBool(id, `{}`)
+	if err != nil {
+		t.Errorf("err is not nil: %v", goString(err))
+	}
+	if !allowed {
+		t.Errorf("allowed after failed replace: got %v, expected %v", allowed, true)
+	}
+}
+
+func TestRegoReplaceModule_keepsOptions(t *testing.T) {
+	query := "data.example.allow"
+	modulename := "example.rego"
+
+	restricted, err := RegoNewRestricted(query, modulename, `package example
+
+	allow { input.user == "admin" }`, `["http.send"]`)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+	defer RegoDrop(restricted)
+
+	err = RegoReplaceModule(restricted, query, modulename, `package example
+
+	allow {
+		http.send({"method": "get", "url": "http://localhost"}).status_code == 200
+	}`)
+	if err == nil {
+		t.Fatal("expected error replacing a restricted module with one calling a blocked builtin")
+	}
+	e := decodeError(t, goString(err))
+	if e.Code != codeCompile || !strings.Contains(e.Message, "http.send") {
+		t.Errorf("error: got %s, expected a compile error naming http.send", goString(err))
+	}
+
+	withRuntime, err := RegoNewWithRuntime("data.example.region", modulename, `package example
+
+	region = "none"`, `{"region": "us-west"}`)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+	defer RegoDrop(withRuntime)
+
+	if err := RegoReplaceModule(withRuntime, "data.example.region", modulename, `package example
+
+	region = opa.runtime().region`); err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+
+	region, err := RegoEvalString(withRuntime, `{}`)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+	if goString(region) != "us-west" {
+		t.Errorf("region: got %v, expected %v", goString(region), "us-west")
+	}
+}
+
+func TestRegoEvaluator(t *testing.T) {
+	query := "data.example.allow"
+	modulename := "example.rego"
+
+	e1 := RegoNewEvaluator()
+	defer RegoDropEvaluator(e1)
+	e2 := RegoNewEvaluator()
+	defer RegoDropEvaluator(e2)
+
+	id1, err := RegoEvaluatorNew(e1, query, modulename, `package example
+
+	default allow = true`)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+
+	id2, err := RegoEvaluatorNew(e2, query, modulename, `package example
+
+	default allow = false`)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+
+	if id1 != 1 || id2 != 1 {
+		t.Errorf("ids: got %d and %d, expected each evaluator to start at 1", id1, id2)
+	}
+
+	result, err := RegoEvaluatorEval(e1, id1, `{}`)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+	if !strings.Contains(goString(result), `"value":true`) {
+		t.Errorf("result: got %s, expected allow to be true", goString(result))
+	}
+
+	result, err = RegoEvaluatorEval(e2, id2, `{}`)
+	if err != nil {
+		t.Fatalf("err is not nil: %v", goString(err))
+	}
+	if !strings.Contains(goString(result), `"value":false`) {
+		t.Errorf("result: got %s, expected allow to be false", goString(result))
+	}
+
+	RegoDropEvaluator(e2)
+
+	_, err = RegoEvaluatorEval(e2, id2, `{}`)
+	if e := decodeError(t, goString(err)); e.Code != codeNotFound {
+		t.Errorf("code: got %v, expected %v", e.Code, codeNotFound)
+	}
+}
+
+func TestRegoSelfTest(t *testing.T) {
+	if err := RegoSelfTest(); err != nil {
+		t.Errorf("err is not nil: %v", goString(err))
+	}
+}
+
+type fakeFileInfo struct {
+	os.FileInfo
+	dir bool
+}
+
+func (fi fakeFileInfo) IsDir() bool { return fi.dir }
+
+func TestLoaderFilter(t *testing.T) {
+	tests := []struct {
+		ignore   string
+		path     string
+		dir      bool
+		expected bool
+	}{
+		{"*_test.rego", "policy_test.rego", false, true},
+		{"*_test.rego", "authz/policy_test.rego", false, true},
+		{"*_test.rego", "authz/policy.rego", false, false},
+		{"tests/**", "tests/unit/policy.rego", false, true},
+		{"tests/**", "authz/tests/policy.rego", false, false},
+		{"vendor/", "vendor", true, true},
+		{"vendor/", "vendor", false, false},
+		{"vendor/", "lib/vendor/policy.rego", false, true},
+		{"/vendor", "lib/vendor/policy.rego", false, false},
+		{"a/**/c.rego", "a/b/b/c.rego", false, true},
+		{"a/**/c.rego", "a/c.rego", false, true},
+		{"a/b", "a/b/c/d.rego", false, true},
+	}
+
+	for _, tc := range tests {
+		f := loaderFilter{Ignore: []string{tc.ignore}}
+		abspath := "/root/" + tc.path
+		depth := len(strings.Split(tc.path, "/"))
+
+		if actual := f.Apply(abspath, fakeFileInfo{dir: tc.dir}, depth); actual != tc.expected {
+			t.Errorf("%q ignoring %q: got %v, expected %v", tc.ignore, tc.path, actual, tc.expected)
+		}
+	}
+
+	if (loaderFilter{Ignore: []string{"*"}}).Apply("/root", fakeFileInfo{dir: true}, 0) {
+		t.Errorf("the root path was ignored")
+	}
+}
+
+func TestWasmBuildWithReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "opa-wasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"policy.rego": `package example
+
+		default allow = false`,
+		"data.json": `{"example": {"admin": "alice"}}`,
+		"README.md": `# Example`,
+		"tests/policy_test.rego": `package example
+
+		test_allow { not allow }`,
+	}
+
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ptr, _, report, cerr := WasmBuildWithReport("data.example.allow", []string{dir}, nil, []string{"tests/"})
+	if cerr != nil {
+		t.Fatalf("err is not nil: %v", goString(cerr))
+	}
+	defer Free(ptr)
+
+	var r struct {
+		Loaded  []string `json:"loaded"`
+		Ignored []string `json:"ignored"`
+	}
+	if err := json.Unmarshal([]byte(goString(report)), &r); err != nil {
+		t.Fatalf("could not unmarshal report: %v", err)
+	}
+
+	expectedLoaded := []string{filepath.Join(dir, "data.json"), filepath.Join(dir, "policy.rego")}
+	if fmt.Sprint(r.Loaded) != fmt.Sprint(expectedLoaded) {
+		t.Errorf("loaded: got %v, expected %v", r.Loaded, expectedLoaded)
+	}
+
+	expectedIgnored := []string{filepath.Join(dir, "tests")}
+	if fmt.Sprint(r.Ignored) != fmt.Sprint(expectedIgnored) {
+		t.Errorf("ignored: got %v, expected %v", r.Ignored, expectedIgnored)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+// Helpers for the tests, which cannot use cgo themselves. They live apart
+// from opa.go so that the library built from it does not include them.
+
+/*
+#include <stdlib.h>
+#include <string.h>
+
+typedef char* (*builtin_callback)(unsigned long long token, char* args, char** err);
+
+// echo_builtin is a builtin callback that returns its arguments array as the
+// result.
+static char* echo_builtin(unsigned long long token, char* args, char** err) {
+	char* result = malloc(strlen(args) + 1);
+	strcpy(result, args);
+	return result;
+}
+
+typedef void (*decision_log_callback)(unsigned long long token, char* decision);
+
+// capture_decision is a decision log callback that keeps a copy of the last
+// decision logged in last_decision.
+static char* last_decision = NULL;
+
+static void capture_decision(unsigned long long token, char* decision) {
+	free(last_decision);
+	last_decision = malloc(strlen(decision) + 1);
+	strcpy(last_decision, decision);
+}
+*/
+import "C"
+
+import "unsafe"
+
+// goString and goBytes copy C memory into Go values.
+func goString(s *C.char) string {
+	return C.GoString(s)
+}
+
+func goBytes(ptr unsafe.Pointer, n int) []byte {
+	return C.GoBytes(ptr, C.int(n))
+}
+
+// echoBuiltinCallback returns a builtin callback whose builtins evaluate to
+// the array of their arguments.
+func echoBuiltinCallback() C.builtin_callback {
+	return C.builtin_callback(C.echo_builtin)
+}
+
+// captureDecisionCallback returns a decision log callback that keeps the last
+// decision logged, which lastDecision returns.
+func captureDecisionCallback() C.decision_log_callback {
+	return C.decision_log_callback(C.capture_decision)
+}
+
+func lastDecision() string {
+	return C.GoString(C.last_decision)
+}
@@ -1,5 +1,5 @@
 use std::ffi::CStr;
-use std::os::raw::{c_char, c_void};
+use std::os::raw::c_char;
 use std::{error, fmt};
 
 use opa_go_sys::*;
@@ -9,12 +9,21 @@ pub mod wasm;
 
 #[derive(Debug)]
 pub struct Error {
+    code: String,
     message: String,
 }
 
 impl Error {
     fn new(message: String) -> Self {
-        Self { message }
+        Self {
+            code: "invalid_input".to_string(),
+            message,
+        }
+    }
+
+    /// The machine-readable error code, e.g. `compile_error` or `timeout`.
+    pub fn code(&self) -> &str {
+        &self.code
     }
 }
 
@@ -30,6 +39,8 @@ impl error::Error for Error {
     }
 }
 
+/// An error string returned by opa-go-sys. The string is owned by the caller
+/// and is freed when the `GoError` is dropped.
 struct GoError {
     ptr: *const c_char,
 }
@@ -37,15 +48,25 @@ struct GoError {
 impl Drop for GoError {
     fn drop(&mut self) {
         if !self.ptr.is_null() {
-            unsafe { Free(self.ptr as *mut c_void) }
+            unsafe { FreeCString(self.ptr as *mut c_char) }
         }
     }
 }
 
 impl From<GoError> for Error {
     fn from(error: GoError) -> Self {
-        let message = unsafe { CStr::from_ptr(error.ptr).to_string_lossy().into_owned() };
-        Self { message }
+        let raw = unsafe { CStr::from_ptr(error.ptr).to_string_lossy().into_owned() };
+        let value: serde_json::Value = serde_json::from_str(&raw).unwrap_or_default();
+        match (value["code"].as_str(), value["message"].as_str()) {
+            (Some(code), Some(message)) => Self {
+                code: code.to_string(),
+                message: message.to_string(),
+            },
+            _ => Self {
+                code: "internal_error".to_string(),
+                message: raw,
+            },
+        }
     }
 }
 
@@ -99,6 +120,19 @@ impl Rego {
     }
 }
 
+impl Clone for Rego {
+    fn clone(&self) -> Self {
+        let err = unsafe { RegoRetain(self.id) };
+        if !err.is_null() {
+            let e = Error::from(GoError {
+                ptr: err as *const c_char,
+            });
+            panic!("failed to retain policy {}: {:?}", self.id, e);
+        }
+        Self { id: self.id }
+    }
+}
+
 impl Drop for Rego {
     fn drop(&mut self) {
         unsafe { RegoDrop(self.id) }
@@ -97,7 +97,10 @@ fn build(
         Ok(r)
     } else {
         let message = "Result and error pointers are both null.".to_string();
-        let e = Error { message };
+        let e = Error {
+            code: "internal_error".to_string(),
+            message,
+        };
         Err(e)
     }
 }